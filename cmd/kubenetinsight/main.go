@@ -2,40 +2,66 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/cilium/ebpf/rlimit"
 
+	"github.com/paras-bhavnani/KubeNetInsight/pkg/config"
 	"github.com/paras-bhavnani/KubeNetInsight/pkg/ebpf"
 	"github.com/paras-bhavnani/KubeNetInsight/pkg/kubernetes"
 	"github.com/paras-bhavnani/KubeNetInsight/pkg/metrics"
 )
 
+const cacheSyncTimeout = 60 * time.Second
+
 func main() {
+	configPath := flag.String("config", config.DefaultPath, "path to the KubeNetInsight config file")
+	removePins := flag.Bool("remove-pins", false, "detach the pinned programs and remove the pinned maps, then exit")
+	flag.Parse()
+
 	log.Println("Starting KubeNetInsight...")
 
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	if *removePins {
+		if cfg.PinPath == "" {
+			log.Fatal("No pin_path is configured")
+		}
+		if err := ebpf.RemovePins(cfg.PinPath); err != nil {
+			log.Fatalf("Failed to remove pins: %v", err)
+		}
+		log.Printf("Removed the pins under %s", cfg.PinPath)
+		return
+	}
+
 	// Remove the default memlock limit so we can load eBPF maps/programs
 	if err := rlimit.RemoveMemlock(); err != nil {
 		log.Fatalf("failed to remove memlock rlimit: %v", err)
 	}
 
-	// Initialize eBPF collector
-	collector, err := ebpf.NewCollector()
-	if err != nil {
-		log.Fatalf("Failed to initialize eBPF collector: %v", err)
-	}
-
 	// Initialize Kubernetes client
 	kubeClient, err := kubernetes.NewClient()
 	if err != nil {
 		log.Fatalf("Failed to initialize Kubernetes client: %v", err)
 	}
 
+	// Initialize eBPF collector
+	collector, err := ebpf.NewCollector(cfg.Config, kubeClient)
+	if err != nil {
+		log.Fatalf("Failed to initialize eBPF collector: %v", err)
+	}
+
 	// Initialize metrics exporter
 	exporter, err := metrics.NewExporter()
 	if err != nil {
@@ -43,55 +69,123 @@ func main() {
 	}
 
 	// Start the metrics server
-	go exporter.StartServer("8080")
+	go exporter.StartServer(fmt.Sprintf("%d", cfg.MetricsPort))
 
 	// Set up context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Start the Kubernetes informers and wait for the initial sync
+	kubeClient.Start(ctx)
+	syncCtx, syncCancel := context.WithTimeout(ctx, cacheSyncTimeout)
+	if kubeClient.WaitForCacheSync(syncCtx) {
+		log.Println("Kubernetes caches synced")
+	} else {
+		log.Println("Kubernetes caches not synced yet, lookups will be retried on later ticks")
+	}
+	syncCancel()
+
 	// Start monitoring
 	go func() {
-		if err := startMonitoring(ctx, collector, kubeClient, exporter); err != nil {
+		if err := startMonitoring(ctx, collector, kubeClient, exporter, cfg.PollInterval.Duration, cfg.Events); err != nil {
 			log.Printf("Monitoring stopped: %v", err)
 			cancel()
 		}
 	}()
 
-	// Set up signal handling for graceful shutdown
+	// Set up signal handling for graceful shutdown, and SIGHUP to reload
+	// the filter and sample rate from the config file
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Wait for termination signal
-	<-sigCh
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reloadConfig(collector, *configPath)
+	}
 	log.Println("Shutting down KubeNetInsight...")
 	cancel()
 	time.Sleep(2 * time.Second) // Give some time for goroutines to clean up
 }
 
-func startMonitoring(ctx context.Context, collector *ebpf.Collector, kubeClient *kubernetes.Client, exporter *metrics.Exporter) error {
+// reloadConfig applies the filter and default sample rate of the config file
+// to the running datapath. Other settings take effect on the next restart.
+func reloadConfig(collector *ebpf.Collector, path string) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		log.Printf("Failed to reload config: %v", err)
+		return
+	}
+	if err := collector.SetFilter(cfg.Filter); err != nil {
+		log.Printf("Failed to update filter: %v", err)
+		return
+	}
+	log.Printf("Filter updated: %d included CIDRs, %d excluded CIDRs, %d ports",
+		len(cfg.Filter.IncludeCIDRs), len(cfg.Filter.ExcludeCIDRs), len(cfg.Filter.Ports))
+	if err := collector.SetSampleRate(cfg.SampleRate); err != nil {
+		log.Printf("Failed to update sample rate: %v", err)
+		return
+	}
+	log.Printf("Default sample rate: 1 in %d packets", max(cfg.SampleRate, 1))
+}
+
+func startMonitoring(ctx context.Context, collector *ebpf.Collector, kubeClient *kubernetes.Client, exporter *metrics.Exporter, pollInterval time.Duration, events bool) error {
 	// Start the eBPF collector
 	if err := collector.Start(); err != nil {
 		return err
 	}
 	defer collector.Stop()
 
-	ticker := time.NewTicker(10 * time.Second)
+	if events {
+		ch, err := collector.Events(eventBuffer)
+		if err != nil {
+			return err
+		}
+		go consumeEvents(ch, exporter)
+	}
+
+	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 
+	deltas := newCounterDeltas()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		case <-ticker.C:
-			// Periodically fetch Kubernetes resources and update metrics
+			// Periodically update metrics from the Kubernetes caches
 			if err := updateKubernetesMetrics(kubeClient, exporter); err != nil {
 				log.Printf("Failed to update Kubernetes metrics: %v", err)
 			}
 
+			// Report the attach mode and sample rate of every interface
+			modes := make(map[string]string)
+			rates := make(map[string]uint32)
+			for _, a := range collector.Attachments() {
+				modes[a.Interface] = a.Mode
+				rates[a.Interface] = a.SampleRate
+			}
+			exporter.SetAttachmentModes(modes)
+			exporter.SetSampleRates(rates)
+
+			if events {
+				if err := updateLostEvents(collector, exporter, deltas); err != nil {
+					log.Printf("Failed to update lost events: %v", err)
+				}
+			}
+
 			// Read and process eBPF data
-			if err := processEBPFData(collector, kubeClient, exporter); err != nil {
+			if err := processEBPFData(collector, kubeClient, exporter, deltas); err != nil {
 				log.Printf("Failed to process eBPF data: %v", err)
 			}
+
+			// Report how full the eBPF maps were when read above
+			if err := updateMapMetrics(collector, exporter, deltas); err != nil {
+				log.Printf("Failed to update map metrics: %v", err)
+			}
 		}
 	}
 }
@@ -121,106 +215,480 @@ func updateKubernetesMetrics(kubeClient *kubernetes.Client, exporter *metrics.Ex
 	return nil
 }
 
-func processEBPFData(collector *ebpf.Collector, kubeClient *kubernetes.Client, exporter *metrics.Exporter) error {
-	// Get consolidated stats
-	packetStats, err := collector.GetPacketStats()
+func updateMapMetrics(collector *ebpf.Collector, exporter *metrics.Exporter, deltas *counterDeltas) error {
+	usage, err := collector.GetMapUsage()
+	if err != nil {
+		return err
+	}
+
+	failures := make(map[string]uint64, len(usage))
+	for _, u := range usage {
+		exporter.SetMapUsage(u.Name, float64(u.Entries), float64(u.MaxEntries))
+		failures[u.Name] = u.InsertFailures
+	}
+	for name, delta := range deltas.mapFailures.Update(failures) {
+		exporter.AddMapInsertFailures(name, float64(delta))
+		if delta > 0 {
+			log.Printf("Map %s: %d inserts failed since the last tick", name, delta)
+		}
+	}
+	return nil
+}
+
+// eventBuffer is the number of events queued for consumeEvents before the
+// ring buffer starts to fill.
+const eventBuffer = 4096
+
+// consumeEvents counts the events of the event stream until it is closed.
+func consumeEvents(events <-chan ebpf.Event, exporter *metrics.Exporter) {
+	for event := range events {
+		exporter.IncrementFlowEvents(event.Type.String())
+	}
+}
+
+func updateLostEvents(collector *ebpf.Collector, exporter *metrics.Exporter, deltas *counterDeltas) error {
+	loss, err := collector.LostEvents()
 	if err != nil {
-		return fmt.Errorf("failed to get packet stats: %v", err)
+		return err
 	}
+	lost := map[string]uint64{"kernel": loss.Kernel, "userspace": loss.Userspace}
+	for source, delta := range deltas.lostEvents.Update(lost) {
+		exporter.AddLostEvents(source, float64(delta))
+		if delta > 0 {
+			log.Printf("Lost %d events (%s) since the last tick", delta, source)
+		}
+	}
+	return nil
+}
+
+// counterDeltas converts the cumulative eBPF map readings into the increase
+// since the previous tick before they are added to Prometheus counters.
+// Flows are tracked individually and their increases summed per address
+// pair, so a flow that expires or is evicted never looks like a counter reset
+// of the pair.
+type counterDeltas struct {
+	bytes       *metrics.DeltaTracker[connKey]
+	drops       *metrics.DeltaTracker[dropKey]
+	tcpEvents   *metrics.DeltaTracker[string]
+	mapFailures *metrics.DeltaTracker[string]
+	lostEvents  *metrics.DeltaTracker[string]
+	retransmits *metrics.DeltaTracker[retransmitKey]
+	protocols   *metrics.DeltaTracker[string]
+	icmp        *metrics.DeltaTracker[icmpKey]
+}
+
+type pairKey struct {
+	Source      netip.Addr
+	Destination netip.Addr
+}
+
+type connKey struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	SourcePort  uint16
+	DestPort    uint16
+	Protocol    string
+	Direction   string
+}
+
+type dropKey struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	SourcePort  uint16
+	DestPort    uint16
+	Protocol    uint8
+	Reason      string
+	Netns       uint32
+}
+
+type podDropKey struct {
+	Namespace string
+	Pod       string
+	Reason    string
+}
 
-	connStats, err := collector.GetConnectionStats()
+type retransmitKey struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	SourcePort  uint16
+	DestPort    uint16
+	Kind        string
+}
+
+type workloadRetransmitKey struct {
+	SrcNamespace, SrcKind, SrcName string
+	DstNamespace, DstKind, DstName string
+	Kind                           string
+}
+
+type icmpKey struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	Protocol    string
+	Type        uint8
+	Code        uint8
+	Message     string
+}
+
+func newCounterDeltas() *counterDeltas {
+	return &counterDeltas{
+		bytes:       metrics.NewDeltaTracker[connKey](),
+		drops:       metrics.NewDeltaTracker[dropKey](),
+		tcpEvents:   metrics.NewDeltaTracker[string](),
+		mapFailures: metrics.NewDeltaTracker[string](),
+		lostEvents:  metrics.NewDeltaTracker[string](),
+		retransmits: metrics.NewDeltaTracker[retransmitKey](),
+		protocols:   metrics.NewDeltaTracker[string](),
+		icmp:        metrics.NewDeltaTracker[icmpKey](),
+	}
+}
+
+func processEBPFData(collector *ebpf.Collector, kubeClient *kubernetes.Client, exporter *metrics.Exporter, deltas *counterDeltas) error {
+	// Read every flow once so packet and connection stats agree
+	snapshot, err := collector.Snapshot()
 	if err != nil {
-		return fmt.Errorf("failed to get connection stats: %v", err)
+		return fmt.Errorf("failed to take snapshot: %v", err)
 	}
+	packetStats := snapshot.PacketStats()
+	connStats := collector.ConnectionStats(snapshot)
 
 	// Get packet drops
-	drops, err := collector.GetPacketDrops()
+	drops, err := collector.GetDrops()
 	if err != nil {
 		return fmt.Errorf("failed to get packet drops: %v", err)
 	}
 
+	byteReadings := make(map[connKey]uint64, len(connStats))
+	for _, conn := range connStats {
+		key := connKey{conn.Source, conn.Destination, conn.SourcePort, conn.DestPort, conn.Protocol, conn.Direction}
+		byteReadings[key] = conn.Bytes
+	}
+	connDeltas := deltas.bytes.Update(byteReadings)
+	byteDeltas := make(map[pairKey]uint64)
+	for key, delta := range connDeltas {
+		byteDeltas[pairKey{key.Source, key.Destination}] += delta
+	}
+
 	// Create maps for summary statistics
 	packetCounts := make(map[string]map[string]uint64)
 	bytesCounts := make(map[string]map[string]uint64)
+	workloadSummaries := make(map[string]*WorkloadSummary)
 	// protocolCounts := make(map[string]uint64)
 
 	// Process packet statistics
 	fmt.Println("Network Traffic Summary:")
 	for _, stat := range packetStats {
-		srcResource, srcNamespace, _ := correlateWithKubernetes(kubeClient, stat.Source)
-		dstResource, dstNamespace, _ := correlateWithKubernetes(kubeClient, stat.Destination)
+		source, destination := stat.Source.String(), stat.Destination.String()
+		key := pairKey{stat.Source, stat.Destination}
+		// Attribute traffic to whoever owned the addresses when it was last seen
+		srcResource, srcNamespace, _ := correlateWithKubernetes(kubeClient, source, stat.LastSeen)
+		dstResource, dstNamespace, _ := correlateWithKubernetes(kubeClient, destination, stat.LastSeen)
 
 		// Update summary statistics maps
-		if _, ok := packetCounts[stat.Source]; !ok {
-			packetCounts[stat.Source] = make(map[string]uint64)
-			bytesCounts[stat.Source] = make(map[string]uint64)
+		if _, ok := packetCounts[source]; !ok {
+			packetCounts[source] = make(map[string]uint64)
+			bytesCounts[source] = make(map[string]uint64)
 		}
-		packetCounts[stat.Source][stat.Destination] = stat.Count
-		bytesCounts[stat.Source][stat.Destination] = stat.Bytes
+		packetCounts[source][destination] = stat.Count
+		bytesCounts[source][destination] = stat.Bytes
 
-		fmt.Printf("  %s/%s -> %s/%s: %d packets, %d bytes, %s avg latency\n",
+		fmt.Printf("  %s/%s -> %s/%s: %d packets, %d bytes, %s avg RTT\n",
 			srcNamespace, srcResource, dstNamespace, dstResource,
 			stat.Count, stat.Bytes, formatLatency(stat.Latency))
 
-		exporter.AddNetworkTraffic(stat.Source, stat.Destination, float64(stat.Count))
-		exporter.ObserveConnectionLatency(stat.Source, stat.Destination, float64(stat.Latency))
-
-		protocol := "unknown"
-		for _, conn := range connStats {
-			if conn.Source == stat.Source && conn.Destination == stat.Destination {
-				protocol = conn.Protocol
-				break
-			}
+		// Aggregate by workload so pod churn does not split the series
+		srcWorkload := resolveWorkload(kubeClient, source, stat.LastSeen)
+		dstWorkload := resolveWorkload(kubeClient, destination, stat.LastSeen)
+		summaryKey := srcWorkload.String() + " -> " + dstWorkload.String()
+		summary, ok := workloadSummaries[summaryKey]
+		if !ok {
+			summary = &WorkloadSummary{Source: srcWorkload.String(), Destination: dstWorkload.String()}
+			workloadSummaries[summaryKey] = summary
 		}
+		summary.PacketCount += stat.Count
+		summary.Bytes += stat.Bytes
+		exporter.AddWorkloadTraffic(
+			srcWorkload.Namespace, srcWorkload.Kind, srcWorkload.Name,
+			dstWorkload.Namespace, dstWorkload.Kind, dstWorkload.Name,
+			float64(byteDeltas[key]),
+		)
 
-		exporter.ObservePacketSize(stat.Source, stat.Destination, protocol, float64(stat.Bytes/stat.Count))
+		exporter.AddNetworkTraffic(source, destination, float64(byteDeltas[key]))
+	}
+
+	if err := updateHistograms(collector, exporter); err != nil {
+		return err
 	}
 
 	protocolCounts, err := collector.GetProtocolCounts()
 	if err != nil {
 		return fmt.Errorf("failed to get protocol counts: %v", err)
 	}
+	for protocol, delta := range deltas.protocols.Update(protocolCounts) {
+		exporter.AddProtocolPackets(protocol, float64(delta))
+	}
+
+	icmp, err := collector.GetICMP()
+	if err != nil {
+		return fmt.Errorf("failed to get ICMP messages: %v", err)
+	}
+	processICMP(exporter, icmp, deltas)
 
 	// Process packet drops
-	if len(drops) > 0 {
-		fmt.Println("Packet Drops:")
-		for reason, count := range drops {
-			fmt.Printf("  %s: %d\n", reason, count)
-			exporter.IncrementPacketDrops(reason)
-		}
+	processDrops(kubeClient, exporter, drops, deltas)
+
+	retransmits, err := collector.GetRetransmits()
+	if err != nil {
+		return fmt.Errorf("failed to get TCP retransmissions: %v", err)
 	}
+	processRetransmits(kubeClient, exporter, retransmits, deltas)
 
 	// Process connection statistics
 	fmt.Println("Detailed Connections:")
 	for _, conn := range connStats {
-		srcResource, srcNamespace, _ := correlateWithKubernetes(kubeClient, conn.Source)
-		dstResource, dstNamespace, _ := correlateWithKubernetes(kubeClient, conn.Destination)
+		source, destination := conn.Source.String(), conn.Destination.String()
+		srcResource, srcNamespace, _ := correlateWithKubernetes(kubeClient, source, conn.LastSeen)
+		dstResource, dstNamespace, _ := correlateWithKubernetes(kubeClient, destination, conn.LastSeen)
+		delta := connDeltas[connKey{conn.Source, conn.Destination, conn.SourcePort, conn.DestPort, conn.Protocol, conn.Direction}]
 
 		// Update metrics
-		exporter.AddProtocolTraffic(conn.Protocol, conn.Source, conn.Destination, float64(conn.Count))
-		exporter.SetConnectionState(
-			conn.Source,
-			conn.Destination,
-			conn.SourcePort,
-			conn.DestPort,
-			conn.Protocol,
-			conn.State,
-			float64(conn.Count),
-		)
+		exporter.AddProtocolTraffic(conn.Protocol, source, destination, float64(delta))
 
-		fmt.Printf("  %s/%s:%d -> %s/%s:%d (%s): %d packets [%s]\n",
+		fmt.Printf("  %s/%s:%d -> %s/%s:%d (%s, %s): %d packets, %d bytes [%s]\n",
 			srcNamespace, srcResource, conn.SourcePort,
 			dstNamespace, dstResource, conn.DestPort,
-			conn.Protocol, conn.Count, conn.State)
+			conn.Protocol, conn.Direction, conn.Count, conn.Bytes, conn.State)
+		if conn.Tunnel.Type != ebpf.TunnelNone {
+			fmt.Printf("    via %s tunnel %s -> %s\n", conn.Tunnel.Type, conn.Tunnel.Source, conn.Tunnel.Destination)
+		}
+
+		if conn.Service != "" {
+			exporter.AddServiceTraffic(conn.ServiceNamespace, conn.Service, conn.ServicePortName, conn.BackendPod, float64(delta))
+			if conn.ServiceReadyEndpoints == 0 {
+				exporter.AddNoEndpointsTraffic(conn.ServiceNamespace, conn.Service, conn.ServicePortName, float64(delta))
+			}
+			fmt.Printf("    via service %s/%s port %q -> backend %q (%d ready endpoints)\n",
+				conn.ServiceNamespace, conn.Service, conn.ServicePortName, conn.BackendPod, conn.ServiceReadyEndpoints)
+		}
+	}
+
+	// Process TCP connection lifecycle
+	tcpConns, err := collector.GetTCPConnections()
+	if err != nil {
+		return fmt.Errorf("failed to get TCP connections: %v", err)
+	}
+	tcpEvents, err := collector.GetTCPEventCounts()
+	if err != nil {
+		return fmt.Errorf("failed to get TCP events: %v", err)
+	}
+	tcpEventDeltas := deltas.tcpEvents.Update(map[string]uint64{
+		"open":  tcpEvents.Opens,
+		"close": tcpEvents.Closes,
+		"reset": tcpEvents.Resets,
+	})
+	for event, delta := range tcpEventDeltas {
+		exporter.AddTCPConnectionEvents(event, float64(delta))
+	}
+
+	fmt.Printf("TCP Connections: %d opened, %d closed, %d reset\n", tcpEvents.Opens, tcpEvents.Closes, tcpEvents.Resets)
+	now := time.Now()
+	states := make(map[string]int)
+	for _, conn := range tcpConns {
+		states[conn.State]++
+	}
+	exporter.SetConnectionStates(states)
+	for _, conn := range tcpConns {
+		if !conn.Ended {
+			continue
+		}
+		source, destination := conn.Source.String(), conn.Destination.String()
+		// Peers outside the cluster share one series, so that every
+		// client IP does not add a histogram
+		srcWorkload := clusterWorkload(kubeClient, source, now)
+		dstWorkload := clusterWorkload(kubeClient, destination, now)
+		exporter.ObserveTCPConnectionDuration(
+			srcWorkload.Namespace, srcWorkload.Kind, srcWorkload.Name,
+			dstWorkload.Namespace, dstWorkload.Kind, dstWorkload.Name,
+			conn.State, conn.Duration.Seconds(),
+		)
+		fmt.Printf("  %s:%d -> %s:%d %s after %s\n",
+			source, conn.SourcePort, destination, conn.DestPort, conn.State, conn.Duration)
+	}
+
+	// Expired flows were read at least once after their last packet, since
+	// the idle timeout exceeds the poll interval, so they add no traffic.
+	ended := collector.EndedFlows()
+	if len(ended) > 0 {
+		fmt.Printf("Flows Ended: %d\n", len(ended))
+		for _, flow := range ended {
+			exporter.AddFlowsEnded(flow.ProtocolName(), 1)
+			fmt.Printf("  %s:%d -> %s:%d (%s, %s): %d packets, %d bytes over %s\n",
+				flow.SrcIP, flow.SrcPort, flow.DstIP, flow.DstPort,
+				flow.ProtocolName(), flow.DirectionName(), flow.Packets, flow.Bytes,
+				flow.LastSeen.Sub(flow.FirstSeen))
+		}
 	}
 
 	// Print summary statistics
-	printSummaryStats(packetCounts, bytesCounts, protocolCounts)
+	printSummaryStats(packetCounts, bytesCounts, protocolCounts, workloadSummaries)
 
 	return nil
 }
 
-func printSummaryStats(packetCounts map[string]map[string]uint64, bytesCounts map[string]map[string]uint64, protocolCounts map[string]uint64) {
+// processDrops adds the drops since the previous tick per reason, and per
+// pod for drops to or from a pod. A drop is attributed to its destination
+// pod when it has one, since most drops happen on the receive path.
+func processDrops(kubeClient *kubernetes.Client, exporter *metrics.Exporter, drops []ebpf.DropStats, deltas *counterDeltas) {
+	// Drops carry no timestamp; the new ones happened since the last tick
+	now := time.Now()
+	readings := make(map[dropKey]uint64, len(drops))
+	for _, drop := range drops {
+		key := dropKey{drop.Source, drop.Destination, drop.SourcePort, drop.DestPort, drop.Protocol, drop.Reason, drop.Netns}
+		readings[key] = drop.Count
+	}
+
+	byReason := make(map[string]uint64)
+	byPod := make(map[podDropKey]uint64)
+	for key, delta := range deltas.drops.Update(readings) {
+		if delta == 0 {
+			continue
+		}
+		byReason[key.Reason] += delta
+		for _, addr := range []netip.Addr{key.Destination, key.Source} {
+			if addr.IsUnspecified() {
+				continue
+			}
+			if pod, namespace, err := kubeClient.GetPodByIPAt(addr.String(), now); err == nil && pod != "" {
+				byPod[podDropKey{namespace, pod, key.Reason}] += delta
+				break
+			}
+		}
+	}
+
+	if len(byReason) > 0 {
+		fmt.Println("Packet Drops:")
+		for reason, count := range byReason {
+			fmt.Printf("  %s: %d\n", reason, count)
+			exporter.AddPacketDrops(reason, float64(count))
+		}
+	}
+	for key, count := range byPod {
+		exporter.AddPodPacketDrops(key.Namespace, key.Pod, key.Reason, float64(count))
+	}
+}
+
+// processRetransmits adds the retransmissions since the previous tick per
+// workload pair, and prints the connections that retransmitted.
+func processRetransmits(kubeClient *kubernetes.Client, exporter *metrics.Exporter, retransmits []ebpf.RetransmitStats, deltas *counterDeltas) {
+	readings := make(map[retransmitKey]uint64, len(retransmits))
+	for _, r := range retransmits {
+		readings[retransmitKey{r.Source, r.Destination, r.SourcePort, r.DestPort, r.Kind}] = r.Count
+	}
+
+	now := time.Now()
+	byWorkload := make(map[workloadRetransmitKey]uint64)
+	printed := false
+	for key, delta := range deltas.retransmits.Update(readings) {
+		if delta == 0 {
+			continue
+		}
+		if !printed {
+			fmt.Println("TCP Retransmissions:")
+			printed = true
+		}
+		fmt.Printf("  %s:%d -> %s:%d (%s): %d\n", key.Source, key.SourcePort, key.Destination, key.DestPort, key.Kind, delta)
+
+		src := resolveWorkload(kubeClient, key.Source.String(), now)
+		dst := resolveWorkload(kubeClient, key.Destination.String(), now)
+		byWorkload[workloadRetransmitKey{src.Namespace, src.Kind, src.Name, dst.Namespace, dst.Kind, dst.Name, key.Kind}] += delta
+	}
+
+	for key, count := range byWorkload {
+		exporter.AddRetransmissions(
+			key.SrcNamespace, key.SrcKind, key.SrcName,
+			key.DstNamespace, key.DstKind, key.DstName,
+			key.Kind, float64(count),
+		)
+	}
+}
+
+// processICMP adds the ICMP messages since the previous tick, and prints the
+// error messages that point at MTU and routing problems.
+func processICMP(exporter *metrics.Exporter, icmp []ebpf.ICMPStats, deltas *counterDeltas) {
+	readings := make(map[icmpKey]uint64, len(icmp))
+	for _, m := range icmp {
+		readings[icmpKey{m.Source, m.Destination, m.Protocol, m.Type, m.Code, m.Message}] = m.Count
+	}
+
+	printed := false
+	for key, delta := range deltas.icmp.Update(readings) {
+		if delta == 0 {
+			continue
+		}
+		exporter.AddICMPMessages(
+			key.Source.String(), key.Destination.String(), key.Protocol, key.Message,
+			strconv.Itoa(int(key.Type)), strconv.Itoa(int(key.Code)), float64(delta),
+		)
+
+		switch key.Message {
+		case "dest_unreachable", "frag_needed", "ttl_exceeded":
+			if !printed {
+				fmt.Println("ICMP Errors:")
+				printed = true
+			}
+			fmt.Printf("  %s -> %s: %s %s (type %d, code %d): %d\n",
+				key.Source, key.Destination, key.Protocol, key.Message, key.Type, key.Code, delta)
+		}
+	}
+}
+
+// updateHistograms publishes the packet size and RTT histograms counted in
+// the kernel. They are cumulative, so they replace the previous samples
+// rather than going through a DeltaTracker.
+func updateHistograms(collector *ebpf.Collector, exporter *metrics.Exporter) error {
+	sizes, err := collector.GetPacketSizeHistograms()
+	if err != nil {
+		return fmt.Errorf("failed to get packet size histograms: %v", err)
+	}
+	samples := make([]metrics.HistogramSample, len(sizes))
+	for i, h := range sizes {
+		samples[i] = histogramSample(h, 1, h.Source.String(), h.Destination.String(), h.Kind)
+	}
+	exporter.SetPacketSizes(samples)
+
+	rtts, err := collector.GetRTTHistograms()
+	if err != nil {
+		return fmt.Errorf("failed to get RTT histograms: %v", err)
+	}
+	samples = make([]metrics.HistogramSample, len(rtts))
+	for i, h := range rtts {
+		// RTTs are bucketed in microseconds
+		samples[i] = histogramSample(h, 1e-6, h.Source.String(), h.Destination.String(), h.Kind)
+	}
+	exporter.SetConnectionLatencies(samples)
+	return nil
+}
+
+// histogramSample converts a kernel log2 histogram to cumulative Prometheus
+// buckets, whose le bound is the largest value of each kernel bucket,
+// multiplying the bounds and sum by scale. The last bucket is
+// unbounded and only counts towards +Inf.
+func histogramSample(h ebpf.Histogram, scale float64, labels ...string) metrics.HistogramSample {
+	sample := metrics.HistogramSample{
+		Labels:  labels,
+		Count:   h.Count,
+		Sum:     float64(h.Sum) * scale,
+		Buckets: make(map[float64]uint64, len(h.Buckets)-1),
+	}
+	var cumulative uint64
+	for i, n := range h.Buckets[:len(h.Buckets)-1] {
+		cumulative += n
+		sample.Buckets[float64(h.UpperBound(i))*scale] = cumulative
+	}
+	return sample
+}
+
+func printSummaryStats(packetCounts map[string]map[string]uint64, bytesCounts map[string]map[string]uint64, protocolCounts map[string]uint64, workloadSummaries map[string]*WorkloadSummary) {
 	var totalPackets, totalBytes uint64
 	var uniqueSources, uniqueDestinations int
 	sourcesSet := make(map[string]bool)
@@ -247,11 +715,18 @@ func printSummaryStats(packetCounts map[string]map[string]uint64, bytesCounts ma
 	for proto, count := range protocolCounts {
 		fmt.Printf("  - %s: %d packets\n", proto, count)
 	}
+	fmt.Println("- Workload Traffic:")
+	for _, summary := range workloadSummaries {
+		fmt.Printf("  - %s -> %s: %d packets, %d bytes\n",
+			summary.Source, summary.Destination, summary.PacketCount, summary.Bytes)
+	}
 	fmt.Println("--------------------")
 }
 
-func correlateWithKubernetes(kubeClient *kubernetes.Client, ip string) (string, string, error) {
-	pod, namespace, err := kubeClient.GetPodByIP(ip)
+// correlateWithKubernetes resolves ip to the pod that owned it at ts, falling
+// back to a service ClusterIP.
+func correlateWithKubernetes(kubeClient *kubernetes.Client, ip string, ts time.Time) (string, string, error) {
+	pod, namespace, err := kubeClient.GetPodByIPAt(ip, ts)
 	if err == nil {
 		return fmt.Sprintf("%s (Pod)", pod), namespace, nil
 	}
@@ -264,6 +739,31 @@ func correlateWithKubernetes(kubeClient *kubernetes.Client, ip string) (string,
 	return ip, "", nil
 }
 
+// resolveWorkload maps ip to its owning workload, falling back to the bare IP
+// for traffic that does not belong to the cluster.
+func resolveWorkload(kubeClient *kubernetes.Client, ip string, ts time.Time) kubernetes.Workload {
+	if workload, err := kubeClient.ResolveWorkload(ip, ts); err == nil {
+		return *workload
+	}
+	return kubernetes.Workload{Kind: "IP", Name: ip}
+}
+
+// clusterWorkload maps ip to its owning workload like resolveWorkload, but
+// groups every address outside the cluster under a single External workload.
+func clusterWorkload(kubeClient *kubernetes.Client, ip string, ts time.Time) kubernetes.Workload {
+	if workload, err := kubeClient.ResolveWorkload(ip, ts); err == nil {
+		return *workload
+	}
+	return kubernetes.Workload{Kind: "External"}
+}
+
+type WorkloadSummary struct {
+	Source      string
+	Destination string
+	PacketCount uint64
+	Bytes       uint64
+}
+
 type ConnectionSummary struct {
 	Source      string
 	Destination string
@@ -1,184 +1,1057 @@
 #include <linux/bpf.h>
 #include <linux/if_ether.h>
 #include <linux/ip.h>
+#include <linux/ipv6.h>
 #include <linux/in.h>
 #include <linux/tcp.h>
 #include <linux/udp.h>
+#include <linux/pkt_cls.h>
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_endian.h>
+#include <bpf/bpf_tracing.h>
+#include <bpf/bpf_core_read.h>
 
-struct ip_key {
-    __u32 src_ip;
-    __u32 dst_ip;
+// Direction of a packet relative to the interface it was observed on
+#define DIR_INGRESS 0
+#define DIR_EGRESS  1
+
+// Bound on IPv6 extension headers walked before giving up on the L4 header
+#define MAX_IPV6_EXT_HEADERS 6
+
+// 802.1Q tags skipped per Ethernet header: one, or two for 802.1ad QinQ
+#define MAX_VLAN_TAGS 2
+
+// Encapsulations decapsulated to reach the pod traffic, mirrored in pkg/ebpf.
+// Only one level is removed.
+#define TUNNEL_NONE   0
+#define TUNNEL_VXLAN  1
+#define TUNNEL_GENEVE 2
+#define TUNNEL_IPIP   3 // IPv4 or IPv6 carried directly in IPv4 or IPv6
+
+// Size of sample_rates; interfaces with a larger ifindex use the default rate
+#define MAX_SAMPLED_IFINDEX 65536
+
+// Actions of cidr_filter entries, mirrored in pkg/ebpf
+#define FILTER_INCLUDE 1
+#define FILTER_EXCLUDE 2
+
+// filter_config flags, set by the collector from the rules it installed
+#define FILTER_F_INCLUDE 0x1 // cidr_filter has FILTER_INCLUDE entries
+#define FILTER_F_EXCLUDE 0x2 // cidr_filter has FILTER_EXCLUDE entries
+#define FILTER_F_PORTS   0x4 // port_filter is not empty
+
+#define VXLAN_HDR_LEN 8
+#define ETH_P_TEB     0x6558 // Transparent Ethernet Bridging, Geneve payload
+
+// TCP header flags (byte 13 of the TCP header)
+#define TH_FIN 0x01
+#define TH_SYN 0x02
+#define TH_RST 0x04
+#define TH_ACK 0x10
+
+// TCP connection states, mirrored in pkg/ebpf
+#define TCP_STATE_SYN_SENT    1
+#define TCP_STATE_ESTABLISHED 2
+#define TCP_STATE_FIN_WAIT    3
+#define TCP_STATE_CLOSED      4
+#define TCP_STATE_RESET       5
+
+// Indexes into tcp_events
+#define TCP_EVENT_OPEN  0
+#define TCP_EVENT_CLOSE 1
+#define TCP_EVENT_RESET 2
+
+// Indexes into map_errors, mirrored in pkg/ebpf. Renumbering these, the TCP
+// states or TCP_EVENT_* changes the meaning of pinned maps, so it must bump
+// mapSchemaVersion in pkg/ebpf/pin.go.
+#define MAP_ID_FLOW          0
+#define MAP_ID_TCP_CONN      1
+#define MAP_ID_LATENCY       2
+#define MAP_ID_DROP          3
+#define MAP_ID_EVENTS        4 // events lost to a full ring buffer
+#define MAP_ID_RETRANSMIT    5
+#define MAP_ID_ICMP          6
+#define MAP_ID_SIZE_HIST     7
+#define MAP_ID_RTT_HIST      8
+#define MAP_ID_MAX           9
+
+// Buckets of the log2 histograms, mirrored in pkg/ebpf. Bucket i counts the
+// values in [2^i, 2^(i+1)); zero falls in the first bucket and anything at
+// or above 2^(HIST_BUCKETS-1) in the last.
+#define HIST_BUCKETS 24
+
+// Kinds of RTT sample in latency_map
+#define RTT_HANDSHAKE 0 // SYN to SYN-ACK, or to the initiator's ACK
+#define RTT_DATA      1 // data segment to the ACK covering it
+
+// Event types sent through the events ring buffer, mirrored in pkg/ebpf
+#define EVENT_FLOW_START 1
+#define EVENT_FLOW_END   2
+#define EVENT_TCP_RESET  3
+#define EVENT_DROP       4
+
+// Kinds of TCP retransmission in retransmit_map
+#define RETRANS_DATA   0 // tcp_retransmit_skb
+#define RETRANS_SYNACK 1 // tcp_retransmit_synack
+
+#ifndef IPPROTO_ICMPV6
+#define IPPROTO_ICMPV6 58
+#endif
+
+#ifndef AF_INET
+#define AF_INET  2
+#define AF_INET6 10
+#endif
+
+#ifndef EEXIST
+#define EEXIST 17
+#endif
+
+// Per-flow maps are LRU so that a full map evicts the least recently used
+// entry instead of refusing new flows. Their max_entries are defaults that
+// the collector may override at load time; idle flows are expired from
+// userspace.
+//
+// Counters live in per-CPU maps so that packets on different cores never
+// contend on a shared entry. Each CPU updates only its own copy without
+// atomics, and userspace sums the copies when reading.
+
+// Addresses are stored as 16-byte IPv6 addresses in network byte order.
+// IPv4 addresses use the IPv4-mapped form ::ffff:a.b.c.d.
+
+// RTT samples are keyed from the host that sent the timed segment to its
+// peer: initiator to responder for the handshake.
+struct rtt_key {
+    __u32 src_ip[4];
+    __u32 dst_ip[4];
+    __u8 kind;
+};
+
+struct rtt_data {
+    __u64 total_ns;
+    __u64 samples;
 };
 
 struct {
-    __uint(type, BPF_MAP_TYPE_HASH);
-    __type(key, struct ip_key);
+    __uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH);
+    __type(key, struct rtt_key);
+    __type(value, struct rtt_data);
+    __uint(max_entries, 16384);
+} latency_map SEC(".maps");
+
+// Packets freed by the kernel with a drop reason, per tuple and netns
+struct drop_key {
+    __u32 src_ip[4];
+    __u32 dst_ip[4];
+    __u16 src_port;
+    __u16 dst_port;
+    __u8 protocol;
+    __u8 pad[3];
+    __u32 reason; // enum skb_drop_reason of the running kernel
+    __u32 netns;  // inode number of the network namespace
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH);
+    __type(key, struct drop_key);
     __type(value, __u64);
-    __uint(max_entries, 1024);
-} packet_count SEC(".maps");
+    __uint(max_entries, 16384);
+} drop_map SEC(".maps");
+
+// A flow is one direction of a 5-tuple as seen on one hook
+struct flow_key {
+    __u32 src_ip[4];
+    __u32 dst_ip[4];
+    __u16 src_port;
+    __u16 dst_port;
+    __u8 protocol;
+    __u8 direction;
+};
 
-struct latency_data {
-    __u64 total_latency;
-    __u64 packet_count;
+struct flow_stats {
+    __u64 packets;
+    __u64 bytes;
+    __u64 first_seen; // bpf_ktime_get_ns()
+    __u64 last_seen;
+    __u32 tunnel_src[4]; // outer endpoints of the latest encapsulated packet
+    __u32 tunnel_dst[4];
+    __u8 tcp_flags;   // every TCP flag seen on the flow
+    __u8 tunnel_type; // TUNNEL_*, TUNNEL_NONE when not encapsulated
+    __u32 sample_rate; // rate of the latest sampled packet, for information
 };
 
 struct {
-    __uint(type, BPF_MAP_TYPE_HASH);
-    __type(key, struct ip_key);
-    __type(value, struct latency_data);
-    __uint(max_entries, 1024);
-} latency_map SEC(".maps");
+    __uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH);
+    __type(key, struct flow_key);
+    __type(value, struct flow_stats);
+    __uint(max_entries, 65536);
+} flow_map SEC(".maps");
 
+// Packets per IP protocol number, indexed by the protocol
 struct {
-    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
     __type(key, __u32);
     __type(value, __u64);
-    __uint(max_entries, 16);
-} drop_map SEC(".maps");
+    __uint(max_entries, 256);
+} protocol_count SEC(".maps");
+
+// ICMP and ICMPv6 messages per address pair, type and code
+struct icmp_key {
+    __u32 src_ip[4];
+    __u32 dst_ip[4];
+    __u8 protocol; // IPPROTO_ICMP or IPPROTO_ICMPV6
+    __u8 type;
+    __u8 code;
+};
 
 struct {
-    __uint(type, BPF_MAP_TYPE_HASH);
-    __type(key, struct ip_key);
+    __uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH);
+    __type(key, struct icmp_key);
     __type(value, __u64);
-    __uint(max_entries, 1024);
-} packet_size SEC(".maps");
+    __uint(max_entries, 16384);
+} icmp_map SEC(".maps");
+
+// Log2 histograms per address pair. kind is the IP protocol in size_hist and
+// RTT_* in rtt_hist.
+struct hist_key {
+    __u32 src_ip[4];
+    __u32 dst_ip[4];
+    __u8 kind;
+};
+
+struct hist {
+    __u64 buckets[HIST_BUCKETS];
+    __u64 sum;
+};
+
+// Inserted as the initial value, since a struct hist is too large to build
+// on the stack next to the packet being parsed
+static const struct hist empty_hist;
+
+// Packet sizes in bytes, as on the wire
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH);
+    __type(key, struct hist_key);
+    __type(value, struct hist);
+    __uint(max_entries, 4096);
+} size_hist SEC(".maps");
 
-struct conn_info {
-    __u32 src_ip;
-    __u32 dst_ip;
+// RTT samples in microseconds, keyed like latency_map
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH);
+    __type(key, struct hist_key);
+    __type(value, struct hist);
+    __uint(max_entries, 4096);
+} rtt_hist SEC(".maps");
+
+// A TCP connection keyed from initiator to responder
+struct tcp_conn_key {
+    __u32 src_ip[4];
+    __u32 dst_ip[4];
     __u16 src_port;
     __u16 dst_port;
-    __u8 protocol;
+};
+
+struct tcp_conn_state {
+    __u64 start_ts;
+    __u64 established_ts;
+    __u64 end_ts;     // close or reset, or the first FIN while in FIN_WAIT
+    __u64 sample_ts;  // when the timed data segment was seen
+    __u32 sample_end; // sequence number the peer must acknowledge
+    __u8 state;
+    __u8 fin_flags;   // bit 0: initiator sent FIN, bit 1: responder sent FIN
+    __u8 tcp_flags;   // every flag seen on the connection
+    __u8 sample_from; // 0: no sample, 1: initiator's segment, 2: responder's
 };
 
 struct {
-    __uint(type, BPF_MAP_TYPE_HASH);
-    __type(key, struct conn_info);
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct tcp_conn_key);
+    __type(value, struct tcp_conn_state);
+    __uint(max_entries, 65536);
+} tcp_conn_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, __u32);
     __type(value, __u64);
+    __uint(max_entries, 3);
+} tcp_events SEC(".maps");
+
+// TCP retransmissions per connection, keyed from the local socket to its peer
+struct retrans_key {
+    __u32 src_ip[4];
+    __u32 dst_ip[4];
+    __u16 src_port;
+    __u16 dst_port;
+    __u8 kind;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH);
+    __type(key, struct retrans_key);
+    __type(value, __u64);
+    __uint(max_entries, 16384);
+} retransmit_map SEC(".maps");
+
+// CIDR rules selecting the traffic that is recorded, written by the collector
+// at runtime. The most specific rule covering an address applies to it.
+struct lpm_key {
+    __u32 prefixlen; // of the 128-bit address, so 96 + n for an IPv4 /n
+    __u32 addr[4];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __type(key, struct lpm_key);
+    __type(value, __u8); // FILTER_INCLUDE or FILTER_EXCLUDE
+    __uint(max_entries, 1024);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} cidr_filter SEC(".maps");
+
+// Ports to record, in host byte order
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, __u16);
+    __type(value, __u8);
     __uint(max_entries, 1024);
-} connection_map SEC(".maps");
+} port_filter SEC(".maps");
 
+// Sampling rates written by the collector, indexed by ifindex: 1 in N packets
+// is recorded in flow_map and size_hist. Index 0 holds the default for
+// interfaces without a rate of their own. 0 and 1 record every packet.
 struct {
     __uint(type, BPF_MAP_TYPE_ARRAY);
     __type(key, __u32);
-    __type(value, __u64);
-    __uint(max_entries, 2);
-} protocol_count SEC(".maps");
+    __type(value, __u32);
+    __uint(max_entries, MAX_SAMPLED_IFINDEX);
+} sample_rates SEC(".maps");
 
+// Interfaces, by ifindex, where decapsulated packets are not recorded. The
+// collector lists the uplinks here while it is also attached to pod
+// interfaces, which see the same packets again once decapsulated.
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
-    __type(key, struct ip_key);
-    __type(value, __u64);
+    __type(key, __u32);
+    __type(value, __u8);
     __uint(max_entries, 1024);
-} packet_start_time SEC(".maps");
+} skip_decapsulated SEC(".maps");
 
-static __always_inline int process_packet(struct xdp_md *ctx, __u64 *ts) {
-    void *data_end = (void *)(long)ctx->data_end;
-    void *data = (void *)(long)ctx->data;
-    struct ethhdr *eth = data;
+// Single entry of FILTER_F_* flags, so that unused filters cost no lookups
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, __u32);
+    __uint(max_entries, 1);
+} filter_config SEC(".maps");
 
-    if ((void *)(eth + 1) > data_end)
-        return XDP_PASS;
+// Failed inserts per map, indexed by MAP_ID_*
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, __u32);
+    __type(value, __u64);
+    __uint(max_entries, MAP_ID_MAX);
+} map_errors SEC(".maps");
 
-    if (eth->h_proto != bpf_htons(ETH_P_IP))
-        return XDP_PASS;
+// map_update counts failed inserts so that a full map is visible instead of
+// silently losing data. -EEXIST from a BPF_NOEXIST race is not a failure.
+static __always_inline long map_update(void *map, __u32 map_id, const void *key,
+                                       const void *value, __u64 flags) {
+    long ret = bpf_map_update_elem(map, key, value, flags);
+    if (ret != 0 && ret != -EEXIST) {
+        __u64 *errors = bpf_map_lookup_elem(&map_errors, &map_id);
+        if (errors)
+            *errors += 1;
+    }
+    return ret;
+}
+
+// Parsed L3/L4 fields of a packet
+struct packet_info {
+    __u32 src_ip[4];
+    __u32 dst_ip[4];
+    __u16 src_port;
+    __u16 dst_port;
+    __u8 protocol;
+    __u8 tcp_flags;
+    __u32 l4_len;      // bytes from the L4 header to the end of the IP packet
+    __u32 seq;         // TCP only, host byte order
+    __u32 ack_seq;
+    __u32 payload_len; // TCP payload bytes
+    __u8 icmp_type;    // ICMP and ICMPv6 only
+    __u8 icmp_code;
+    __u8 tunnel_type;  // set when the fields above describe an inner packet
+    __u32 tunnel_src[4];
+    __u32 tunnel_dst[4];
+};
+
+// Set by the collector at load time to time data segments as well as the
+// handshake.
+volatile const __u8 data_rtt_enabled = 0;
 
-    struct iphdr *ip = (void *)(eth + 1);
+// UDP destination ports of the overlay tunnels. The collector may override
+// them at load time, for example with 8472 for flannel's VXLAN.
+volatile const __u16 vxlan_port = 4789;
+volatile const __u16 geneve_port = 6081;
+
+// 802.1Q and 802.1ad tag, following the MAC addresses
+struct vlan_hdr {
+    __be16 h_vlan_TCI;
+    __be16 h_vlan_encapsulated_proto;
+};
+
+// Geneve header (RFC 8926 section 3.4), before its variable-length options
+struct geneve_hdr {
+    __u8 ver_opt_len; // 2-bit version, 6-bit option length in 4-byte words
+    __u8 flags;
+    __be16 protocol;
+    __u8 vni[3];
+    __u8 reserved;
+};
+
+// IPv6 fragment header (RFC 8200 section 4.5)
+struct ipv6_frag_hdr {
+    __u8 nexthdr;
+    __u8 reserved;
+    __be16 frag_off;
+    __be32 identification;
+};
+
+struct flow_event {
+    __u64 ts;
+    struct flow_key flow;
+    __u8 type;
+    __u8 tcp_flags;
+    __u16 pad;
+    __u32 reason; // drop reason for EVENT_DROP, final TCP state for EVENT_FLOW_END
+    __u64 packets;
+    __u64 bytes;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} events SEC(".maps");
+
+// Set by the collector at load time when the event stream is enabled, so
+// that an unread ring buffer does not count every event as lost.
+volatile const __u8 events_enabled = 0;
+
+static __always_inline void emit_event(__u8 type, struct flow_key *flow, __u32 reason,
+                                       __u8 tcp_flags, __u64 packets, __u64 bytes, __u64 ts) {
+    if (!events_enabled)
+        return;
+
+    struct flow_event *e = bpf_ringbuf_reserve(&events, sizeof(*e), 0);
+    if (!e) {
+        __u32 map_id = MAP_ID_EVENTS;
+        __u64 *lost = bpf_map_lookup_elem(&map_errors, &map_id);
+        if (lost)
+            *lost += 1;
+        return;
+    }
+    __builtin_memset(e, 0, sizeof(*e));
+    e->ts = ts;
+    if (flow)
+        __builtin_memcpy(&e->flow, flow, sizeof(e->flow));
+    e->type = type;
+    e->tcp_flags = tcp_flags;
+    e->reason = reason;
+    e->packets = packets;
+    e->bytes = bytes;
+    bpf_ringbuf_submit(e, 0);
+}
+
+static __always_inline void ipv4_mapped(__u32 *addr, __be32 ip) {
+    addr[0] = 0;
+    addr[1] = 0;
+    addr[2] = bpf_htonl(0x0000ffff);
+    addr[3] = ip;
+}
+
+static __always_inline int parse_ipv4(void *l3, void *data_end, struct packet_info *pkt, void **l4) {
+    struct iphdr *ip = l3;
     if ((void *)(ip + 1) > data_end)
-        return XDP_PASS;
+        return -1;
 
-    struct ip_key key = {
-        .src_ip = ip->saddr,
-        .dst_ip = ip->daddr
-    };
+    // Options extend the header past 20 bytes
+    __u32 hdr_len = ip->ihl * 4;
+    if (hdr_len < sizeof(*ip))
+        return -1;
 
-    // Add packet size tracking
-    __u64 packet_len = (__u64)(data_end - data);
-    __u64 *size = bpf_map_lookup_elem(&packet_size, &key);
-    if (size) {
-        __sync_fetch_and_add(size, packet_len);
-    } else {
-        bpf_map_update_elem(&packet_size, &key, &packet_len, BPF_ANY);
+    ipv4_mapped(pkt->src_ip, ip->saddr);
+    ipv4_mapped(pkt->dst_ip, ip->daddr);
+    pkt->protocol = ip->protocol;
+
+    // Only the first fragment carries the L4 header
+    if (ip->frag_off & bpf_htons(0x1fff)) {
+        *l4 = NULL;
+        return 0;
+    }
+    *l4 = l3 + hdr_len;
+    __u16 tot_len = bpf_ntohs(ip->tot_len);
+    if (tot_len > hdr_len)
+        pkt->l4_len = tot_len - hdr_len;
+    return 0;
+}
+
+static __always_inline int ipv6_is_ext_header(__u8 nexthdr) {
+    return nexthdr == IPPROTO_HOPOPTS || nexthdr == IPPROTO_ROUTING ||
+           nexthdr == IPPROTO_FRAGMENT || nexthdr == IPPROTO_DSTOPTS ||
+           nexthdr == IPPROTO_AH;
+}
+
+static __always_inline int parse_ipv6(void *l3, void *data_end, struct packet_info *pkt, void **l4) {
+    struct ipv6hdr *ip6 = l3;
+    if ((void *)(ip6 + 1) > data_end)
+        return -1;
+
+    __builtin_memcpy(pkt->src_ip, &ip6->saddr, sizeof(pkt->src_ip));
+    __builtin_memcpy(pkt->dst_ip, &ip6->daddr, sizeof(pkt->dst_ip));
+
+    __u8 nexthdr = ip6->nexthdr;
+    void *cursor = (void *)(ip6 + 1);
+
+#pragma unroll
+    for (int i = 0; i < MAX_IPV6_EXT_HEADERS; i++) {
+        if (!ipv6_is_ext_header(nexthdr))
+            break;
+
+        struct ipv6_opt_hdr *opt = cursor;
+        if ((void *)(opt + 1) > data_end)
+            return -1;
+
+        if (nexthdr == IPPROTO_FRAGMENT) {
+            struct ipv6_frag_hdr *frag = cursor;
+            if ((void *)(frag + 1) > data_end)
+                return -1;
+            // Only the first fragment carries the L4 header
+            if (frag->frag_off & bpf_htons(0xfff8)) {
+                pkt->protocol = frag->nexthdr;
+                *l4 = NULL;
+                return 0;
+            }
+            cursor += sizeof(*frag);
+        } else if (nexthdr == IPPROTO_AH) {
+            cursor += (opt->hdrlen + 2) << 2;
+        } else {
+            cursor += (opt->hdrlen + 1) << 3;
+        }
+        nexthdr = opt->nexthdr;
+    }
+
+    // Still inside the extension header chain after the bound
+    if (ipv6_is_ext_header(nexthdr)) {
+        pkt->protocol = nexthdr;
+        *l4 = NULL;
+        return 0;
     }
 
-    struct conn_info conn = {
-        .src_ip = ip->saddr,
-        .dst_ip = ip->daddr,
-        .protocol = ip->protocol
-    };
+    pkt->protocol = nexthdr;
+    *l4 = cursor;
+    __u32 ip_len = sizeof(*ip6) + bpf_ntohs(ip6->payload_len);
+    __u32 hdr_len = cursor - l3;
+    if (ip_len > hdr_len)
+        pkt->l4_len = ip_len - hdr_len;
+    return 0;
+}
+
+// parse_l3 parses the IPv4 or IPv6 header of ethertype proto. Other
+// ethertypes return -1.
+static __always_inline int parse_l3(__be16 proto, void *l3, void *data_end,
+                                    struct packet_info *pkt, void **l4) {
+    if (proto == bpf_htons(ETH_P_IP))
+        return parse_ipv4(l3, data_end, pkt, l4);
+    if (proto == bpf_htons(ETH_P_IPV6))
+        return parse_ipv6(l3, data_end, pkt, l4);
+    return -1;
+}
+
+// parse_eth skips the Ethernet header and up to MAX_VLAN_TAGS VLAN tags,
+// returning the start of the payload and its ethertype in proto.
+static __always_inline void *parse_eth(void *data, void *data_end, __be16 *proto) {
+    struct ethhdr *eth = data;
+    if ((void *)(eth + 1) > data_end)
+        return NULL;
 
-    if (ip->protocol == IPPROTO_TCP) {
-        struct tcphdr *tcp = (void *)(ip + 1);
+    __be16 next = eth->h_proto;
+    void *cursor = (void *)(eth + 1);
+
+#pragma unroll
+    for (int i = 0; i < MAX_VLAN_TAGS; i++) {
+        if (next != bpf_htons(ETH_P_8021Q) && next != bpf_htons(ETH_P_8021AD))
+            break;
+        struct vlan_hdr *vlan = cursor;
+        if ((void *)(vlan + 1) > data_end)
+            return NULL;
+        next = vlan->h_vlan_encapsulated_proto;
+        cursor = (void *)(vlan + 1);
+    }
+
+    *proto = next;
+    return cursor;
+}
+
+static __always_inline int parse_ports(void *l4, void *data_end, struct packet_info *pkt) {
+    if (!l4)
+        return 0;
+
+    if (pkt->protocol == IPPROTO_TCP) {
+        struct tcphdr *tcp = l4;
         if ((void *)(tcp + 1) > data_end)
-            return XDP_PASS;
-        conn.src_port = tcp->source;
-        conn.dst_port = tcp->dest;
-    } else if (ip->protocol == IPPROTO_UDP) {
-        struct udphdr *udp = (void *)(ip + 1);
+            return -1;
+        pkt->src_port = tcp->source;
+        pkt->dst_port = tcp->dest;
+        pkt->tcp_flags = ((__u8 *)tcp)[13];
+        pkt->seq = bpf_ntohl(tcp->seq);
+        pkt->ack_seq = bpf_ntohl(tcp->ack_seq);
+        __u32 doff = tcp->doff * 4;
+        if (pkt->l4_len > doff)
+            pkt->payload_len = pkt->l4_len - doff;
+    } else if (pkt->protocol == IPPROTO_UDP) {
+        struct udphdr *udp = l4;
         if ((void *)(udp + 1) > data_end)
-            return XDP_PASS;
-        conn.src_port = udp->source;
-        conn.dst_port = udp->dest;
+            return -1;
+        pkt->src_port = udp->source;
+        pkt->dst_port = udp->dest;
+    } else if (pkt->protocol == IPPROTO_ICMP || pkt->protocol == IPPROTO_ICMPV6) {
+        // Type and code lead both headers
+        __u8 *icmp = l4;
+        if ((void *)(icmp + 2) > data_end)
+            return -1;
+        pkt->icmp_type = icmp[0];
+        pkt->icmp_code = icmp[1];
     }
+    return 0;
+}
 
-    __u64 *conn_count = bpf_map_lookup_elem(&connection_map, &conn);
-    if (conn_count) {
-        __sync_fetch_and_add(conn_count, 1);
-    } else {
-        __u64 initial = 1;
-        bpf_map_update_elem(&connection_map, &conn, &initial, BPF_ANY);
+// decap replaces pkt with the inner packet of a VXLAN, Geneve or IP-in-IP
+// tunnel, keeping the outer addresses as the tunnel endpoints. Anything else,
+// or an inner packet that cannot be parsed, leaves pkt as it is.
+static __always_inline void decap(void *data_end, struct packet_info *pkt, void **l4) {
+    if (!*l4)
+        return;
+
+    __u8 type = TUNNEL_NONE;
+    __be16 inner_proto = 0;
+    void *inner = NULL;
+
+    if (pkt->protocol == IPPROTO_IPIP) {
+        type = TUNNEL_IPIP;
+        inner_proto = bpf_htons(ETH_P_IP);
+        inner = *l4;
+    } else if (pkt->protocol == IPPROTO_IPV6) {
+        type = TUNNEL_IPIP;
+        inner_proto = bpf_htons(ETH_P_IPV6);
+        inner = *l4;
+    } else if (pkt->protocol == IPPROTO_UDP) {
+        void *payload = *l4 + sizeof(struct udphdr);
+        if (pkt->dst_port == bpf_htons(vxlan_port)) {
+            type = TUNNEL_VXLAN;
+            inner = parse_eth(payload + VXLAN_HDR_LEN, data_end, &inner_proto);
+        } else if (pkt->dst_port == bpf_htons(geneve_port)) {
+            struct geneve_hdr *geneve = payload;
+            if ((void *)(geneve + 1) > data_end)
+                return;
+            type = TUNNEL_GENEVE;
+            void *next = (void *)(geneve + 1) + (geneve->ver_opt_len & 0x3f) * 4;
+            if (geneve->protocol == bpf_htons(ETH_P_TEB)) {
+                inner = parse_eth(next, data_end, &inner_proto);
+            } else {
+                inner_proto = geneve->protocol;
+                inner = next;
+            }
+        }
     }
+    if (type == TUNNEL_NONE || !inner)
+        return;
+
+    struct packet_info inner_pkt;
+    __builtin_memset(&inner_pkt, 0, sizeof(inner_pkt));
+    void *inner_l4 = NULL;
+    if (parse_l3(inner_proto, inner, data_end, &inner_pkt, &inner_l4) < 0)
+        return;
+    if (parse_ports(inner_l4, data_end, &inner_pkt) < 0)
+        return;
+
+    inner_pkt.tunnel_type = type;
+    __builtin_memcpy(inner_pkt.tunnel_src, pkt->src_ip, sizeof(inner_pkt.tunnel_src));
+    __builtin_memcpy(inner_pkt.tunnel_dst, pkt->dst_ip, sizeof(inner_pkt.tunnel_dst));
+    __builtin_memcpy(pkt, &inner_pkt, sizeof(*pkt));
+    *l4 = inner_l4;
+}
+
+static __always_inline __u8 cidr_action(__u32 *addr) {
+    struct lpm_key key;
+    key.prefixlen = 128;
+    __builtin_memcpy(key.addr, addr, sizeof(key.addr));
+    __u8 *action = bpf_map_lookup_elem(&cidr_filter, &key);
+    return action ? *action : 0;
+}
+
+// filter_packet reports whether the packet is recorded. A packet is skipped
+// when either address is excluded, when include rules exist and neither
+// address is included, or when a port filter is set and neither port is in
+// it. Packets without ports, such as ICMP or later fragments, pass the port
+// filter.
+static __always_inline int filter_packet(struct packet_info *pkt) {
+    __u32 zero = 0;
+    __u32 *flags = bpf_map_lookup_elem(&filter_config, &zero);
+    if (!flags || !*flags)
+        return 1;
 
-    __u32 proto_index;
-    if (ip->protocol == IPPROTO_TCP) {
-        proto_index = 0;
-    } else if (ip->protocol == IPPROTO_UDP) {
-        proto_index = 1;
+    if (*flags & (FILTER_F_INCLUDE | FILTER_F_EXCLUDE)) {
+        __u8 src = cidr_action(pkt->src_ip);
+        __u8 dst = cidr_action(pkt->dst_ip);
+        if (src == FILTER_EXCLUDE || dst == FILTER_EXCLUDE)
+            return 0;
+        if ((*flags & FILTER_F_INCLUDE) && src != FILTER_INCLUDE && dst != FILTER_INCLUDE)
+            return 0;
+    }
+
+    if ((*flags & FILTER_F_PORTS) && (pkt->src_port || pkt->dst_port)) {
+        __u16 src_port = bpf_ntohs(pkt->src_port);
+        __u16 dst_port = bpf_ntohs(pkt->dst_port);
+        if (!bpf_map_lookup_elem(&port_filter, &src_port) &&
+            !bpf_map_lookup_elem(&port_filter, &dst_port))
+            return 0;
+    }
+    return 1;
+}
+
+// Keys are zeroed first so struct padding never splits identical flows
+static __always_inline void fill_flow_key(struct flow_key *key, struct packet_info *pkt, __u8 direction) {
+    __builtin_memset(key, 0, sizeof(*key));
+    __builtin_memcpy(key->src_ip, pkt->src_ip, sizeof(key->src_ip));
+    __builtin_memcpy(key->dst_ip, pkt->dst_ip, sizeof(key->dst_ip));
+    key->src_port = pkt->src_port;
+    key->dst_port = pkt->dst_port;
+    key->protocol = pkt->protocol;
+    key->direction = direction;
+}
+
+// log2_bucket returns the histogram bucket of v, floor(log2(v)) capped to
+// the last bucket.
+static __always_inline __u32 log2_bucket(__u64 v) {
+    __u32 r = 0;
+#pragma unroll
+    for (int shift = 32; shift > 0; shift >>= 1) {
+        if (v >> shift) {
+            v >>= shift;
+            r += shift;
+        }
+    }
+    return r < HIST_BUCKETS ? r : HIST_BUCKETS - 1;
+}
+
+// record_hist counts value weight times, weight being the number of packets
+// a sampled packet stands for.
+static __always_inline void record_hist(void *map, __u32 map_id, __u32 *src_ip, __u32 *dst_ip,
+                                        __u8 kind, __u64 value, __u32 weight) {
+    struct hist_key key;
+    __builtin_memset(&key, 0, sizeof(key));
+    __builtin_memcpy(key.src_ip, src_ip, sizeof(key.src_ip));
+    __builtin_memcpy(key.dst_ip, dst_ip, sizeof(key.dst_ip));
+    key.kind = kind;
+
+    struct hist *h = bpf_map_lookup_elem(map, &key);
+    if (!h) {
+        map_update(map, map_id, &key, &empty_hist, BPF_NOEXIST);
+        h = bpf_map_lookup_elem(map, &key);
+        if (!h)
+            return;
+    }
+    __u32 bucket = log2_bucket(value);
+    if (bucket < HIST_BUCKETS)
+        h->buckets[bucket] += weight;
+    h->sum += value * weight;
+}
+
+static __always_inline void record_rtt(__u32 *src_ip, __u32 *dst_ip, __u8 kind, __u64 rtt) {
+    record_hist(&rtt_hist, MAP_ID_RTT_HIST, src_ip, dst_ip, kind, rtt / 1000, 1);
+
+    struct rtt_key key;
+    __builtin_memset(&key, 0, sizeof(key));
+    __builtin_memcpy(key.src_ip, src_ip, sizeof(key.src_ip));
+    __builtin_memcpy(key.dst_ip, dst_ip, sizeof(key.dst_ip));
+    key.kind = kind;
+
+    struct rtt_data *data = bpf_map_lookup_elem(&latency_map, &key);
+    if (data) {
+        data->total_ns += rtt;
+        data->samples += 1;
     } else {
-        return XDP_PASS;
+        struct rtt_data init = {rtt, 1};
+        map_update(&latency_map, MAP_ID_LATENCY, &key, &init, BPF_ANY);
     }
+}
 
-    __u64 *proto_count = bpf_map_lookup_elem(&protocol_count, &proto_index);
-    if (proto_count) {
-        __sync_fetch_and_add(proto_count, 1);
+// sample_data_rtt times one data segment per connection at a time, from the
+// segment to the first ACK from the peer that covers it. A retransmission of
+// the timed segment discards the sample, since its ACK would be ambiguous.
+static __always_inline void sample_data_rtt(struct tcp_conn_state *st, struct packet_info *pkt,
+                                            int from_initiator, __u64 ts) {
+    __u8 from = from_initiator ? 1 : 2;
+
+    if (st->sample_from && st->sample_from != from && (pkt->tcp_flags & TH_ACK) &&
+        (__s32)(pkt->ack_seq - st->sample_end) >= 0) {
+        // The ACK travels from the peer back to the sender of the segment
+        if (ts > st->sample_ts)
+            record_rtt(pkt->dst_ip, pkt->src_ip, RTT_DATA, ts - st->sample_ts);
+        st->sample_from = 0;
     }
 
-    // Update packet count
-    __u64 *count = bpf_map_lookup_elem(&packet_count, &key);
+    if (!pkt->payload_len)
+        return;
+    __u32 end = pkt->seq + pkt->payload_len;
+    if (st->sample_from == from && (__s32)(end - st->sample_end) <= 0) {
+        st->sample_from = 0;
+    } else if (!st->sample_from) {
+        st->sample_ts = ts;
+        st->sample_end = end;
+        st->sample_from = from;
+    }
+}
+
+static __always_inline void count_icmp(struct packet_info *pkt) {
+    struct icmp_key key;
+    __builtin_memset(&key, 0, sizeof(key));
+    __builtin_memcpy(key.src_ip, pkt->src_ip, sizeof(key.src_ip));
+    __builtin_memcpy(key.dst_ip, pkt->dst_ip, sizeof(key.dst_ip));
+    key.protocol = pkt->protocol;
+    key.type = pkt->icmp_type;
+    key.code = pkt->icmp_code;
+
+    __u64 *count = bpf_map_lookup_elem(&icmp_map, &key);
     if (count) {
-        __sync_fetch_and_add(count, 1);
-        // bpf_printk("Packet captured: src_ip=%u, dst_ip=%u\n", key.src_ip, key.dst_ip);
+        *count += 1;
     } else {
         __u64 initial = 1;
-        bpf_map_update_elem(&packet_count, &key, &initial, BPF_ANY);
-        // bpf_printk("Packet captured: src_ip=%u, dst_ip=%u\n", key.src_ip, key.dst_ip);
+        map_update(&icmp_map, MAP_ID_ICMP, &key, &initial, BPF_ANY);
+    }
+}
+
+static __always_inline void count_tcp_event(__u32 event) {
+    __u64 *count = bpf_map_lookup_elem(&tcp_events, &event);
+    if (count)
+        *count += 1;
+}
+
+// track_tcp drives the per-connection state machine from the flags of one
+// packet. The connection is looked up in both orientations so that packets
+// from the responder update the initiator's entry.
+static __always_inline void track_tcp(struct packet_info *pkt, __u8 direction, __u64 ts) {
+    struct tcp_conn_key fwd, rev;
+    __builtin_memset(&fwd, 0, sizeof(fwd));
+    __builtin_memset(&rev, 0, sizeof(rev));
+    __builtin_memcpy(fwd.src_ip, pkt->src_ip, sizeof(fwd.src_ip));
+    __builtin_memcpy(fwd.dst_ip, pkt->dst_ip, sizeof(fwd.dst_ip));
+    fwd.src_port = pkt->src_port;
+    fwd.dst_port = pkt->dst_port;
+    __builtin_memcpy(rev.src_ip, pkt->dst_ip, sizeof(rev.src_ip));
+    __builtin_memcpy(rev.dst_ip, pkt->src_ip, sizeof(rev.dst_ip));
+    rev.src_port = pkt->dst_port;
+    rev.dst_port = pkt->src_port;
+
+    __u8 flags = pkt->tcp_flags;
+
+    // A bare SYN starts a new connection, replacing any earlier one on the tuple
+    if ((flags & TH_SYN) && !(flags & TH_ACK)) {
+        struct tcp_conn_state st;
+        __builtin_memset(&st, 0, sizeof(st));
+        st.start_ts = ts;
+        st.state = TCP_STATE_SYN_SENT;
+        st.tcp_flags = flags;
+        map_update(&tcp_conn_map, MAP_ID_TCP_CONN, &fwd, &st, BPF_ANY);
+        return;
+    }
+
+    int from_initiator = 1;
+    struct tcp_conn_key *conn = &fwd;
+    struct tcp_conn_state *st = bpf_map_lookup_elem(&tcp_conn_map, &fwd);
+    if (!st) {
+        st = bpf_map_lookup_elem(&tcp_conn_map, &rev);
+        from_initiator = 0;
+        conn = &rev;
+    }
+
+    if (!st) {
+        // A FIN or RST is more likely the tail of a connection whose entry
+        // was already removed than a connection worth tracking from here
+        if (flags & (TH_RST | TH_FIN))
+            return;
+        // Connection that predates the agent; the sender is assumed to be
+        // the initiator and no open event is counted.
+        struct tcp_conn_state mid;
+        __builtin_memset(&mid, 0, sizeof(mid));
+        mid.start_ts = ts;
+        mid.established_ts = ts;
+        mid.state = TCP_STATE_ESTABLISHED;
+        mid.tcp_flags = flags;
+        map_update(&tcp_conn_map, MAP_ID_TCP_CONN, &fwd, &mid, BPF_NOEXIST);
+        return;
     }
 
-    // Update latency
-    __u64 *start_time = bpf_map_lookup_elem(&packet_start_time, &key);
-    if (start_time) {
-        if (*ts < *start_time) {
-            bpf_printk("Timestamp overflow detected\n");
-            return XDP_PASS;
+    st->tcp_flags |= flags;
+
+    if (flags & TH_RST) {
+        if (st->state != TCP_STATE_RESET && st->state != TCP_STATE_CLOSED) {
+            st->state = TCP_STATE_RESET;
+            st->end_ts = ts;
+            count_tcp_event(TCP_EVENT_RESET);
+
+            struct flow_key key;
+            fill_flow_key(&key, pkt, direction);
+            emit_event(EVENT_TCP_RESET, &key, 0, st->tcp_flags, 0, 0, ts);
         }
-        __u64 latency = *ts - *start_time;
-        struct latency_data *lat_data = bpf_map_lookup_elem(&latency_map, &key);
-        if (lat_data) {
-            __sync_fetch_and_add(&lat_data->total_latency, latency);
-            __sync_fetch_and_add(&lat_data->packet_count, 1);
-        } else {
-            struct latency_data new_data = {latency, 1};
-            if (bpf_map_update_elem(&latency_map, &key, &new_data, BPF_ANY) != 0) {
-                bpf_printk("Failed to update latency map, key: %llu\n", key);
+        return;
+    }
+
+    switch (st->state) {
+    case TCP_STATE_SYN_SENT:
+        // SYN-ACK from the responder, or the initiator's ACK when only one
+        // direction of the handshake is visible on this hook
+        if ((!from_initiator && (flags & TH_SYN) && (flags & TH_ACK)) ||
+            (from_initiator && (flags & TH_ACK))) {
+            st->state = TCP_STATE_ESTABLISHED;
+            st->established_ts = ts;
+            count_tcp_event(TCP_EVENT_OPEN);
+            // Retransmitted SYNs restart start_ts, so the sample is
+            // always taken from the last SYN
+            if (ts > st->start_ts)
+                record_rtt(conn->src_ip, conn->dst_ip, RTT_HANDSHAKE, ts - st->start_ts);
+        }
+        break;
+    case TCP_STATE_ESTABLISHED:
+    case TCP_STATE_FIN_WAIT:
+        if (data_rtt_enabled)
+            sample_data_rtt(st, pkt, from_initiator, ts);
+        if (flags & TH_FIN) {
+            st->fin_flags |= from_initiator ? 1 : 2;
+            if (st->fin_flags == 3) {
+                st->state = TCP_STATE_CLOSED;
+                st->end_ts = ts;
+                count_tcp_event(TCP_EVENT_CLOSE);
+
+                struct flow_key key;
+                fill_flow_key(&key, pkt, direction);
+                emit_event(EVENT_FLOW_END, &key, TCP_STATE_CLOSED, st->tcp_flags, 0, 0, ts);
+            } else if (st->state != TCP_STATE_FIN_WAIT) {
+                st->state = TCP_STATE_FIN_WAIT;
+                st->end_ts = ts;
             }
         }
-        bpf_map_delete_elem(&packet_start_time, &key);
-    } else {
-        if (bpf_map_update_elem(&packet_start_time, &key, ts, BPF_ANY) != 0) {
-            bpf_printk("Failed to update packet_start_time map, key: %llu\n", key);
+        break;
+    }
+}
+
+// update_flow records a packet sampled at 1 in rate. Each sampled packet
+// stands for rate packets, so packets and bytes are scaled as they are
+// accumulated and stay correct when the rate changes.
+static __always_inline void update_flow(struct packet_info *pkt, __u8 direction, __u64 len, __u64 ts,
+                                        __u32 rate) {
+    struct flow_key key;
+    fill_flow_key(&key, pkt, direction);
+
+    // Lookups return this CPU's copy of the flow
+    struct flow_stats *stats = bpf_map_lookup_elem(&flow_map, &key);
+    if (!stats) {
+        struct flow_stats init;
+        __builtin_memset(&init, 0, sizeof(init));
+        init.packets = rate;
+        init.bytes = len * rate;
+        init.first_seen = ts;
+        init.last_seen = ts;
+        init.sample_rate = rate;
+        init.tcp_flags = pkt->tcp_flags;
+        init.tunnel_type = pkt->tunnel_type;
+        __builtin_memcpy(init.tunnel_src, pkt->tunnel_src, sizeof(init.tunnel_src));
+        __builtin_memcpy(init.tunnel_dst, pkt->tunnel_dst, sizeof(init.tunnel_dst));
+        if (map_update(&flow_map, MAP_ID_FLOW, &key, &init, BPF_NOEXIST) == 0) {
+            emit_event(EVENT_FLOW_START, &key, 0, pkt->tcp_flags, rate, len * rate, ts);
+            return;
         }
+        // Another CPU created the flow first
+        stats = bpf_map_lookup_elem(&flow_map, &key);
+        if (!stats)
+            return;
+    }
+    if (stats->first_seen == 0)
+        stats->first_seen = ts;
+    stats->packets += rate;
+    stats->bytes += len * rate;
+    stats->sample_rate = rate;
+    stats->last_seen = ts;
+    stats->tcp_flags |= pkt->tcp_flags;
+    if (pkt->tunnel_type != TUNNEL_NONE) {
+        stats->tunnel_type = pkt->tunnel_type;
+        __builtin_memcpy(stats->tunnel_src, pkt->tunnel_src, sizeof(stats->tunnel_src));
+        __builtin_memcpy(stats->tunnel_dst, pkt->tunnel_dst, sizeof(stats->tunnel_dst));
+    }
+}
+
+static __always_inline __u32 sample_rate(__u32 ifindex) {
+    __u32 *rate = NULL;
+    if (ifindex < MAX_SAMPLED_IFINDEX)
+        rate = bpf_map_lookup_elem(&sample_rates, &ifindex);
+    if (!rate || *rate == 0) {
+        __u32 zero = 0;
+        rate = bpf_map_lookup_elem(&sample_rates, &zero);
+    }
+    if (!rate || *rate == 0)
+        return 1;
+    return *rate;
+}
+
+// process_packet records the packet in every map. With sampling, only 1 in N
+// packets, chosen at random, reaches flow_map and size_hist. Sampling only
+// saves those updates: parsing, the filter lookups, track_tcp with its RTTs,
+// and the ICMP and protocol counters still run on every packet, which keeps
+// them exact.
+//
+// len is the full packet length, which for a non-linear skb exceeds the
+// directly accessible data.
+static __always_inline int process_packet(void *data, void *data_end, __u64 len, __u32 ifindex,
+                                          __u8 direction, __u64 *ts) {
+    __be16 proto = 0;
+    void *l3 = parse_eth(data, data_end, &proto);
+    if (!l3)
+        return XDP_PASS;
+
+    struct packet_info pkt;
+    __builtin_memset(&pkt, 0, sizeof(pkt));
+    void *l4 = NULL;
+
+    if (parse_l3(proto, l3, data_end, &pkt, &l4) < 0)
+        return XDP_PASS;
+    if (parse_ports(l4, data_end, &pkt) < 0)
+        return XDP_PASS;
+
+    // Overlay traffic is accounted to the pods inside the tunnel; len stays
+    // the size on the wire, headers included.
+    decap(data_end, &pkt, &l4);
+    if (pkt.tunnel_type != TUNNEL_NONE && bpf_map_lookup_elem(&skip_decapsulated, &ifindex))
+        return XDP_PASS;
+
+    if (!filter_packet(&pkt))
+        return XDP_PASS;
+
+    if (pkt.protocol == IPPROTO_TCP && l4)
+        track_tcp(&pkt, direction, *ts);
+
+    __u32 rate = sample_rate(ifindex);
+    if (rate <= 1 || bpf_get_prandom_u32() % rate == 0) {
+        update_flow(&pkt, direction, len, *ts, rate);
+        record_hist(&size_hist, MAP_ID_SIZE_HIST, pkt.src_ip, pkt.dst_ip, pkt.protocol, len, rate);
+    }
+
+    if ((pkt.protocol == IPPROTO_ICMP || pkt.protocol == IPPROTO_ICMPV6) && l4)
+        count_icmp(&pkt);
+
+    __u32 proto_index = pkt.protocol;
+    __u64 *proto_count = bpf_map_lookup_elem(&protocol_count, &proto_index);
+    if (proto_count) {
+        *proto_count += 1;
     }
 
     return XDP_PASS;
@@ -187,20 +1060,202 @@ static __always_inline int process_packet(struct xdp_md *ctx, __u64 *ts) {
 SEC("xdp")
 int monitor_packets(struct xdp_md *ctx) {
     __u64 ts = bpf_ktime_get_ns();
-    int ret = process_packet(ctx, &ts);
-
-    if (ret == XDP_DROP) {
-        __u32 reason = 1; // Generic drop reason
-        __u64 *drops = bpf_map_lookup_elem(&drop_map, &reason);
-        if (drops)
-            __sync_fetch_and_add(drops, 1);
-        else {
-            __u64 initial = 1;
-            bpf_map_update_elem(&drop_map, &reason, &initial, BPF_ANY);
+    void *data = (void *)(long)ctx->data;
+    void *data_end = (void *)(long)ctx->data_end;
+    return process_packet(data, data_end, data_end - data, ctx->ingress_ifindex, DIR_INGRESS, &ts);
+}
+
+// The tc programs only observe traffic. TC_ACT_UNSPEC (TCX_NEXT under tcx)
+// hands the packet on to the next program, so that CNI programs attached
+// after ours still run, whether through tcx or a legacy clsact qdisc.
+static __always_inline int monitor_skb(struct __sk_buff *skb, __u8 direction) {
+    __u64 ts = bpf_ktime_get_ns();
+    process_packet((void *)(long)skb->data, (void *)(long)skb->data_end, skb->len, skb->ifindex,
+                   direction, &ts);
+    return TC_ACT_UNSPEC;
+}
+
+SEC("tc")
+int monitor_tc_ingress(struct __sk_buff *skb) {
+    return monitor_skb(skb, DIR_INGRESS);
+}
+
+SEC("tc")
+int monitor_tc_egress(struct __sk_buff *skb) {
+    return monitor_skb(skb, DIR_EGRESS);
+}
+
+// Kernel types read by the tracepoint programs. Only the fields used here are
+// declared; their offsets are relocated against the running kernel's BTF.
+#pragma clang attribute push (__attribute__((preserve_access_index)), apply_to = record)
+struct ns_common {
+    unsigned int inum;
+};
+
+struct net {
+    struct ns_common ns;
+};
+
+typedef struct {
+    struct net *net;
+} possible_net_t;
+
+struct net_device {
+    possible_net_t nd_net;
+};
+
+struct sock_common {
+    __be32 skc_daddr;
+    __be32 skc_rcv_saddr;
+    __be16 skc_dport;
+    __u16 skc_num;
+    unsigned short skc_family;
+    possible_net_t skc_net;
+    struct in6_addr skc_v6_daddr;
+    struct in6_addr skc_v6_rcv_saddr;
+};
+
+struct sock {
+    struct sock_common __sk_common;
+};
+
+struct request_sock {
+    struct sock_common __req_common;
+};
+
+struct sk_buff {
+    struct net_device *dev;
+    struct sock *sk;
+    unsigned char *head;
+    __u16 network_header;
+    __be16 protocol;
+};
+#pragma clang attribute pop
+
+// skb_netns returns the namespace of the device the skb was on, or of its
+// socket when it has no device.
+static __always_inline __u32 skb_netns(struct sk_buff *skb) {
+    struct net_device *dev = BPF_CORE_READ(skb, dev);
+    if (dev)
+        return BPF_CORE_READ(dev, nd_net.net, ns.inum);
+    struct sock *sk = BPF_CORE_READ(skb, sk);
+    if (sk)
+        return BPF_CORE_READ(sk, __sk_common.skc_net.net, ns.inum);
+    return 0;
+}
+
+// parse_skb_tuple reads the addresses and ports of a freed skb. Packets
+// dropped before their network header was set are left without a tuple.
+static __always_inline void parse_skb_tuple(struct sk_buff *skb, struct drop_key *key) {
+    unsigned char *head = BPF_CORE_READ(skb, head);
+    __u16 network_header = BPF_CORE_READ(skb, network_header);
+    __be16 proto = BPF_CORE_READ(skb, protocol);
+    if (!head || network_header == (__u16)~0U)
+        return;
+
+    void *l3 = head + network_header;
+    void *l4;
+    if (proto == bpf_htons(ETH_P_IP)) {
+        struct iphdr ip;
+        if (bpf_probe_read_kernel(&ip, sizeof(ip), l3))
+            return;
+        ipv4_mapped(key->src_ip, ip.saddr);
+        ipv4_mapped(key->dst_ip, ip.daddr);
+        key->protocol = ip.protocol;
+        // Only the first fragment carries the L4 header
+        if (ip.frag_off & bpf_htons(0x1fff))
+            return;
+        l4 = l3 + ip.ihl * 4;
+    } else if (proto == bpf_htons(ETH_P_IPV6)) {
+        struct ipv6hdr ip6;
+        if (bpf_probe_read_kernel(&ip6, sizeof(ip6), l3))
+            return;
+        __builtin_memcpy(key->src_ip, &ip6.saddr, sizeof(key->src_ip));
+        __builtin_memcpy(key->dst_ip, &ip6.daddr, sizeof(key->dst_ip));
+        key->protocol = ip6.nexthdr;
+        l4 = l3 + sizeof(ip6);
+    } else {
+        return;
+    }
+
+    if (key->protocol == IPPROTO_TCP || key->protocol == IPPROTO_UDP) {
+        __be16 ports[2];
+        if (bpf_probe_read_kernel(ports, sizeof(ports), l4) == 0) {
+            key->src_port = ports[0];
+            key->dst_port = ports[1];
         }
     }
+}
 
-    return ret;
+// on_kfree_skb counts every packet the kernel drops, with the reason it gave.
+SEC("tp_btf/kfree_skb")
+int BPF_PROG(on_kfree_skb, struct sk_buff *skb, void *location, int reason) {
+    if (reason == 0) // SKB_NOT_DROPPED_YET
+        return 0;
+
+    struct drop_key key;
+    __builtin_memset(&key, 0, sizeof(key));
+    key.reason = reason;
+    key.netns = skb_netns(skb);
+    parse_skb_tuple(skb, &key);
+
+    __u64 *count = bpf_map_lookup_elem(&drop_map, &key);
+    if (count) {
+        *count += 1;
+    } else {
+        __u64 initial = 1;
+        map_update(&drop_map, MAP_ID_DROP, &key, &initial, BPF_ANY);
+    }
+
+    struct flow_key flow;
+    __builtin_memset(&flow, 0, sizeof(flow));
+    __builtin_memcpy(flow.src_ip, key.src_ip, sizeof(flow.src_ip));
+    __builtin_memcpy(flow.dst_ip, key.dst_ip, sizeof(flow.dst_ip));
+    flow.src_port = key.src_port;
+    flow.dst_port = key.dst_port;
+    flow.protocol = key.protocol;
+    emit_event(EVENT_DROP, &flow, reason, 0, 0, 0, bpf_ktime_get_ns());
+    return 0;
+}
+
+static __always_inline void count_retransmit(struct sock_common *skc, __u8 kind) {
+    struct retrans_key key;
+    __builtin_memset(&key, 0, sizeof(key));
+
+    unsigned short family = BPF_CORE_READ(skc, skc_family);
+    if (family == AF_INET) {
+        ipv4_mapped(key.src_ip, BPF_CORE_READ(skc, skc_rcv_saddr));
+        ipv4_mapped(key.dst_ip, BPF_CORE_READ(skc, skc_daddr));
+    } else if (family == AF_INET6) {
+        BPF_CORE_READ_INTO(&key.src_ip, skc, skc_v6_rcv_saddr);
+        BPF_CORE_READ_INTO(&key.dst_ip, skc, skc_v6_daddr);
+    } else {
+        return;
+    }
+    // skc_num is the local port in host byte order
+    key.src_port = bpf_htons(BPF_CORE_READ(skc, skc_num));
+    key.dst_port = BPF_CORE_READ(skc, skc_dport);
+    key.kind = kind;
+
+    __u64 *count = bpf_map_lookup_elem(&retransmit_map, &key);
+    if (count) {
+        *count += 1;
+    } else {
+        __u64 initial = 1;
+        map_update(&retransmit_map, MAP_ID_RETRANSMIT, &key, &initial, BPF_ANY);
+    }
+}
+
+SEC("tp_btf/tcp_retransmit_skb")
+int BPF_PROG(on_tcp_retransmit_skb, struct sock *sk, struct sk_buff *skb) {
+    count_retransmit(&sk->__sk_common, RETRANS_DATA);
+    return 0;
+}
+
+SEC("tp_btf/tcp_retransmit_synack")
+int BPF_PROG(on_tcp_retransmit_synack, struct sock *sk, struct request_sock *req) {
+    count_retransmit(&req->__req_common, RETRANS_SYNACK);
+    return 0;
 }
 
 char _license[] SEC("license") = "GPL";
\ No newline at end of file
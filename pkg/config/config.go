@@ -0,0 +1,96 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/paras-bhavnani/KubeNetInsight/pkg/ebpf"
+)
+
+// DefaultPath is where the Helm chart mounts the kubenetinsight-config ConfigMap.
+const DefaultPath = "/etc/kubenetinsight/config.yaml"
+
+type Config struct {
+	ebpf.Config
+
+	// Interface is the single-interface form used by older ConfigMaps.
+	Interface    string   `json:"interface"`
+	PollInterval Duration `json:"poll_interval"`
+	// FlowIdleTimeout must exceed PollInterval so that every flow is read
+	// at least once after its last packet before it expires.
+	FlowIdleTimeout     Duration `json:"flow_idle_timeout"`
+	MetricsPort         int      `json:"metrics_port"`
+	LogLevel            string   `json:"log_level"`
+	KubernetesNamespace string   `json:"kubernetes_namespace"`
+}
+
+// Duration is a time.Duration that unmarshals from strings such as "10s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s: %v", data, err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	d.Duration = parsed
+	return nil
+}
+
+const defaultFlowIdleTimeout = 5 * time.Minute
+
+func Default() *Config {
+	cfg := &Config{
+		Config:          ebpf.DefaultConfig(),
+		PollInterval:    Duration{10 * time.Second},
+		FlowIdleTimeout: Duration{defaultFlowIdleTimeout},
+		MetricsPort:     8080,
+		LogLevel:        "info",
+	}
+	cfg.Config.FlowIdleTimeout = defaultFlowIdleTimeout
+	return cfg
+}
+
+// Load reads the config file at path. A missing file yields the defaults.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %v", path, err)
+	}
+
+	// Only replace the default interface list when the file sets one
+	cfg.Interfaces = nil
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+	if cfg.Interface != "" {
+		cfg.Interfaces = append(cfg.Interfaces, ebpf.InterfaceSpec{Name: cfg.Interface})
+	}
+	if len(cfg.Interfaces) == 0 {
+		cfg.Interfaces = ebpf.DefaultConfig().Interfaces
+	}
+	if cfg.PollInterval.Duration <= 0 {
+		return nil, fmt.Errorf("poll_interval must be positive, got %s", cfg.PollInterval.Duration)
+	}
+	if cfg.FlowIdleTimeout.Duration != 0 && cfg.FlowIdleTimeout.Duration <= cfg.PollInterval.Duration {
+		return nil, fmt.Errorf("flow_idle_timeout (%s) must exceed poll_interval (%s)", cfg.FlowIdleTimeout.Duration, cfg.PollInterval.Duration)
+	}
+	cfg.Config.FlowIdleTimeout = cfg.FlowIdleTimeout.Duration
+
+	return cfg, nil
+}
@@ -0,0 +1,295 @@
+package ebpf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Config controls how the Collector attaches to the host.
+type Config struct {
+	// Interfaces lists the interfaces to attach to, by name or glob pattern.
+	Interfaces []InterfaceSpec `json:"interfaces"`
+	// DiscoverInterfaces subscribes to netlink link updates so that matching
+	// interfaces, such as pod veths, are attached and detached as they come
+	// and go.
+	DiscoverInterfaces bool `json:"discover_interfaces"`
+	// MapSizes overrides the max_entries of maps by name, such as
+	// {"flow_map": 262144}, before the collection is loaded.
+	MapSizes map[string]uint32 `json:"map_sizes,omitempty"`
+	// FlowIdleTimeout expires flows that have seen no packet for this long.
+	// Zero disables expiry and leaves eviction to the LRU maps.
+	FlowIdleTimeout time.Duration `json:"-"`
+	// DropReasons attaches to the skb:kfree_skb tracepoint to count the
+	// packets the kernel drops, by reason. It is skipped on kernels without
+	// drop reasons (before 5.17) or BTF.
+	DropReasons bool `json:"drop_reasons"`
+	// Retransmits attaches to the tcp:tcp_retransmit_skb and
+	// tcp:tcp_retransmit_synack tracepoints to count retransmissions per
+	// connection. It is skipped on kernels without BTF.
+	Retransmits bool `json:"retransmits"`
+	// DataRTT times data segments to their ACK in addition to the TCP
+	// handshake, at the cost of per-packet work on established connections.
+	DataRTT bool `json:"data_rtt"`
+	// Events enables the flow event ring buffer read through Events.
+	Events bool `json:"events"`
+	// VXLANPort and GenevePort are the UDP ports decapsulated as VXLAN and
+	// Geneve, so that overlay traffic is keyed on the pod addresses inside
+	// the tunnel. Zero keeps the IANA ports, 4789 and 6081.
+	VXLANPort  uint16 `json:"vxlan_port,omitempty"`
+	GenevePort uint16 `json:"geneve_port,omitempty"`
+	// Filter selects the traffic that is recorded. It can be changed at
+	// runtime with SetFilter.
+	Filter FilterConfig `json:"filter"`
+	// SampleRate records 1 in SampleRate packets, chosen at random, in the
+	// flow map and packet size histograms, whose counts the kernel scales up
+	// as it samples. Filtering, TCP state, RTTs, ICMP and protocol counts
+	// still run on every packet. 0 and 1 record every packet. It can be
+	// changed at runtime with SetSampleRate, and overridden per interface.
+	SampleRate uint32 `json:"sample_rate,omitempty"`
+	// AdaptiveSampling, when set, raises the sampling rates while the agent
+	// is over its CPU or map budget.
+	AdaptiveSampling *AdaptiveSampling `json:"adaptive_sampling,omitempty"`
+	// PinPath is a bpffs directory where maps and XDP, tcx and tracepoint
+	// links are pinned, so that counting carries on across restarts of the
+	// collector and Stop leaves the programs attached. Empty disables
+	// pinning.
+	PinPath string `json:"pin_path,omitempty"`
+}
+
+// Attach modes selectable per interface.
+const (
+	AttachXDP = "xdp"
+	AttachTC  = "tc"
+)
+
+// InterfaceSpec selects interfaces by name or glob pattern such as "cali*".
+type InterfaceSpec struct {
+	Name string `json:"name"`
+	// Attach is AttachXDP (the default, ingress only) or AttachTC, which
+	// observes both ingress and egress through tcx or a clsact qdisc.
+	Attach string `json:"attach,omitempty"`
+	// SampleRate overrides Config.SampleRate on matching interfaces.
+	SampleRate uint32 `json:"sample_rate,omitempty"`
+	// XDPMode is one of the XDPMode constants; XDPModeAuto by default.
+	XDPMode string `json:"xdp_mode,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare string, so that a config may list
+// interfaces as plain names.
+func (s *InterfaceSpec) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		s.Name = name
+		return nil
+	}
+	type plain InterfaceSpec
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// DefaultConfig attaches to eth0 only, matching the historical behaviour.
+func DefaultConfig() Config {
+	return Config{
+		Interfaces:  []InterfaceSpec{{Name: "eth0"}},
+		DropReasons: true,
+		Retransmits: true,
+		VXLANPort:   4789,
+		GenevePort:  6081,
+	}
+}
+
+// attachment holds the hooks attached to a single interface.
+type attachment struct {
+	ifindex int
+	name    string
+	mode    string
+	hooks   []io.Closer
+	// pins are the bpffs paths of the pinned hooks
+	pins []string
+	// podSide is set for veth interfaces, whose other end is in a pod
+	podSide bool
+}
+
+// releaser is implemented by hooks that can outlive the collector.
+type releaser interface {
+	Release() error
+}
+
+// Close detaches every hook.
+func (a *attachment) Close() error {
+	var errs []error
+	for _, hook := range a.hooks {
+		if err := hook.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Release lets go of the hooks while leaving the pinned ones attached, and
+// detaches the others.
+func (a *attachment) Release() error {
+	var errs []error
+	for _, hook := range a.hooks {
+		var err error
+		if r, ok := hook.(releaser); ok {
+			err = r.Release()
+		} else {
+			err = hook.Close()
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// matchInterface returns the first spec whose pattern matches name.
+func (c *Config) matchInterface(name string) (InterfaceSpec, bool) {
+	for _, spec := range c.Interfaces {
+		if ok, err := filepath.Match(spec.Name, name); err == nil && ok {
+			return spec, true
+		}
+	}
+	return InterfaceSpec{}, false
+}
+
+// attachInterface attaches the program to iface unless it is already attached.
+func (c *Collector) attachInterface(iface netlink.Link, spec InterfaceSpec) error {
+	attrs := iface.Attrs()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.attachments == nil {
+		return errors.New("collector is stopped")
+	}
+	if _, ok := c.attachments[attrs.Index]; ok {
+		return nil
+	}
+
+	a := &attachment{ifindex: attrs.Index, name: attrs.Name, podSide: iface.Type() == "veth"}
+	switch spec.Attach {
+	case "", AttachXDP:
+		if err := c.attachXDP(a, spec.XDPMode); err != nil {
+			return fmt.Errorf("failed to attach XDP program to %s: %v", attrs.Name, err)
+		}
+	case AttachTC:
+		if err := c.attachTC(a); err != nil {
+			a.Close()
+			return fmt.Errorf("failed to attach tc programs to %s: %v", attrs.Name, err)
+		}
+	default:
+		return fmt.Errorf("unknown attach mode %q for %s", spec.Attach, attrs.Name)
+	}
+
+	if spec.SampleRate != 0 {
+		if err := c.SetInterfaceSampleRate(attrs.Index, spec.SampleRate); err != nil {
+			log.Printf("Sampling %s at the default rate: %v", attrs.Name, err)
+		}
+	}
+
+	c.attachments[attrs.Index] = a
+	c.updateSkipDecapsulated()
+	log.Printf("eBPF program attached to %s (ifindex %d, mode %s)", attrs.Name, attrs.Index, a.mode)
+	return nil
+}
+
+// AttachmentInfo describes an active attachment and the mode it runs in.
+type AttachmentInfo struct {
+	Interface string
+	Mode      string
+	// SampleRate is the sampling rate in effect on the interface.
+	SampleRate uint32
+}
+
+// Attachments returns the interfaces the program is currently attached to.
+func (c *Collector) Attachments() []AttachmentInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	infos := make([]AttachmentInfo, 0, len(c.attachments))
+	for _, a := range c.attachments {
+		infos = append(infos, AttachmentInfo{Interface: a.name, Mode: a.mode, SampleRate: c.SampleRate(a.ifindex)})
+	}
+	return infos
+}
+
+// detachInterface releases the attachment on ifindex, if any.
+func (c *Collector) detachInterface(ifindex int) {
+	c.mu.Lock()
+	a, ok := c.attachments[ifindex]
+	delete(c.attachments, ifindex)
+	if ok {
+		c.updateSkipDecapsulated()
+	}
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// The ifindex may be reused by an unrelated interface
+	c.samplingMu.Lock()
+	_, sampled := c.sampling.ifaces[ifindex]
+	c.samplingMu.Unlock()
+	if sampled {
+		if err := c.SetInterfaceSampleRate(ifindex, 0); err != nil {
+			log.Printf("Failed to reset sample rate of %s: %v", a.name, err)
+		}
+	}
+
+	// The kernel drops the program with the interface, so closing the link
+	// of a deleted interface is expected to fail.
+	if err := a.Close(); err != nil {
+		log.Printf("Detached from %s: %v", a.name, err)
+		return
+	}
+	log.Printf("eBPF program detached from %s (ifindex %d)", a.name, a.ifindex)
+}
+
+// attachExisting attaches to every current interface that matches the config
+// and returns how many attachments are active.
+func (c *Collector) attachExisting() (int, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list interfaces: %v", err)
+	}
+	for _, iface := range links {
+		spec, ok := c.config.matchInterface(iface.Attrs().Name)
+		if !ok {
+			continue
+		}
+		if err := c.attachInterface(iface, spec); err != nil {
+			log.Printf("Skipping interface: %v", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.attachments), nil
+}
+
+// watchInterfaces attaches to matching interfaces as they appear and releases
+// their attachments when they are removed, until the subscription closes.
+func (c *Collector) watchInterfaces(updates <-chan netlink.LinkUpdate) {
+	for update := range updates {
+		attrs := update.Attrs()
+		switch update.Header.Type {
+		case unix.RTM_NEWLINK:
+			spec, ok := c.config.matchInterface(attrs.Name)
+			if !ok {
+				continue
+			}
+			if err := c.attachInterface(update.Link, spec); err != nil {
+				log.Printf("Failed to attach to new interface: %v", err)
+			}
+		case unix.RTM_DELLINK:
+			c.detachInterface(attrs.Index)
+		}
+	}
+}
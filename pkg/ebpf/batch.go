@@ -0,0 +1,118 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/cilium/ebpf"
+)
+
+// batchSize is the number of entries read per batch syscall. Hash maps fail
+// a batch smaller than one of their buckets, which this comfortably exceeds.
+const batchSize = 1024
+
+// mapDump holds every entry of a map. For per-CPU maps, Values holds CPUs
+// consecutive copies per key, so that the copies of Keys[i] are
+// Values[i*CPUs : (i+1)*CPUs].
+type mapDump[K, V any] struct {
+	Keys   []K
+	Values []V
+	CPUs   int
+}
+
+// PerCPU returns the copies of the i-th entry.
+func (d *mapDump[K, V]) PerCPU(i int) []V {
+	return d.Values[i*d.CPUs : (i+1)*d.CPUs]
+}
+
+// dumpMap reads every entry of m, optionally deleting what it read. It uses
+// batch operations when batch is set and falls back to iterating one key at
+// a time when they fail. K and V must mirror the kernel layout exactly.
+func dumpMap[K, V any](m *ebpf.Map, batch, del bool) (*mapDump[K, V], error) {
+	cpus := 1
+	if hasPerCPUValue(m.Type()) {
+		possible, err := ebpf.PossibleCPU()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get possible CPUs: %v", err)
+		}
+		cpus = possible
+	}
+
+	if batch {
+		dump, err := batchDump[K, V](m, cpus, del)
+		if err == nil {
+			return dump, nil
+		}
+		// Entries already deleted cannot be read again by iterating
+		if del && len(dump.Keys) > 0 {
+			return nil, fmt.Errorf("batch read and delete failed after %d entries: %v", len(dump.Keys), err)
+		}
+		log.Printf("Batch read of map failed, iterating instead: %v", err)
+	}
+	return iterateDump[K, V](m, cpus, del)
+}
+
+func batchDump[K, V any](m *ebpf.Map, cpus int, del bool) (*mapDump[K, V], error) {
+	dump := &mapDump[K, V]{CPUs: cpus}
+	keys := make([]K, batchSize)
+	values := make([]V, batchSize*cpus)
+
+	var cursor ebpf.MapBatchCursor
+	for {
+		var n int
+		var err error
+		if del {
+			n, err = m.BatchLookupAndDelete(&cursor, keys, values, nil)
+		} else {
+			n, err = m.BatchLookup(&cursor, keys, values, nil)
+		}
+		done := errors.Is(err, ebpf.ErrKeyNotExist)
+		if err != nil && !done {
+			return dump, err
+		}
+		// Per-CPU batch reads report some failures as an empty batch
+		// without an error; only ErrKeyNotExist marks the end.
+		if n == 0 && !done {
+			return dump, errors.New("batch read returned no entries")
+		}
+
+		dump.Keys = append(dump.Keys, keys[:n]...)
+		dump.Values = append(dump.Values, values[:n*cpus]...)
+		if done {
+			return dump, nil
+		}
+	}
+}
+
+func iterateDump[K, V any](m *ebpf.Map, cpus int, del bool) (*mapDump[K, V], error) {
+	dump := &mapDump[K, V]{CPUs: cpus}
+	var key K
+
+	entries := m.Iterate()
+	if hasPerCPUValue(m.Type()) {
+		var values []V
+		for entries.Next(&key, &values) {
+			dump.Keys = append(dump.Keys, key)
+			dump.Values = append(dump.Values, values...)
+		}
+	} else {
+		var value V
+		for entries.Next(&key, &value) {
+			dump.Keys = append(dump.Keys, key)
+			dump.Values = append(dump.Values, value)
+		}
+	}
+	if err := entries.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate map: %v", err)
+	}
+
+	if del {
+		for i := range dump.Keys {
+			if err := m.Delete(&dump.Keys[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				return nil, fmt.Errorf("failed to delete entry: %v", err)
+			}
+		}
+	}
+	return dump, nil
+}
@@ -0,0 +1,44 @@
+package ebpf
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// monotonicNow reads CLOCK_MONOTONIC, the clock behind bpf_ktime_get_ns.
+func monotonicNow() (uint64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, fmt.Errorf("failed to read monotonic clock: %v", err)
+	}
+	return uint64(ts.Nano()), nil
+}
+
+// ktimeClock converts bpf_ktime_get_ns timestamps to wall-clock time. It is
+// anchored to a single pair of readings so that every timestamp of a
+// snapshot converts consistently.
+type ktimeClock struct {
+	mono uint64
+	wall time.Time
+}
+
+func newKtimeClock() (ktimeClock, error) {
+	mono, err := monotonicNow()
+	if err != nil {
+		return ktimeClock{}, err
+	}
+	return ktimeClock{mono: mono, wall: time.Now()}, nil
+}
+
+// Time returns the wall-clock time of ns, or the zero time if ns is unset.
+func (k ktimeClock) Time(ns uint64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	if ns > k.mono {
+		return k.wall.Add(time.Duration(ns - k.mono))
+	}
+	return k.wall.Add(-time.Duration(k.mono - ns))
+}
@@ -5,379 +5,512 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/link"
 	"github.com/paras-bhavnani/KubeNetInsight/pkg/kubernetes"
 	"github.com/vishvananda/netlink"
 )
 
 type Collector struct {
-	program          *ebpf.Program
-	packetCountMap   *ebpf.Map
-	latencyMap       *ebpf.Map
-	dropMap          *ebpf.Map
-	packetSizeMap    *ebpf.Map
-	connectionMap    *ebpf.Map
-	protocolCountMap *ebpf.Map
-	link             link.Link
-	kubeClient       *kubernetes.Client
+	program             *ebpf.Program
+	tcIngress           *ebpf.Program
+	tcEgress            *ebpf.Program
+	kfreeSkb            *ebpf.Program
+	tcpRetransmitSkb    *ebpf.Program
+	tcpRetransmitSynack *ebpf.Program
+	flowMap             *ebpf.Map
+	latencyMap          *ebpf.Map
+	dropMap             *ebpf.Map
+	protocolCountMap    *ebpf.Map
+	tcpConnMap          *ebpf.Map
+	tcpEventsMap        *ebpf.Map
+	mapErrorsMap        *ebpf.Map
+	retransmitMap       *ebpf.Map
+	icmpMap             *ebpf.Map
+	sizeHistMap         *ebpf.Map
+	rttHistMap          *ebpf.Map
+	cidrFilterMap       *ebpf.Map
+	portFilterMap       *ebpf.Map
+	filterConfigMap     *ebpf.Map
+	sampleRatesMap      *ebpf.Map
+	skipDecapMap        *ebpf.Map
+	eventsMap           *ebpf.Map
+	kubeClient          *kubernetes.Client
+	config              Config
+	features            KernelFeatures
+	dropReasons         map[uint32]string
+
+	mu          sync.Mutex
+	attachments map[int]*attachment
+	done        chan struct{}
+	events      *eventStream
+	tracing     *attachment
+
+	endedMu    sync.Mutex
+	endedFlows []Flow
+
+	// reportedConns holds the EndTS of the ended TCP connections already
+	// returned by GetTCPConnections, while they stay in the map
+	tcpMu         sync.Mutex
+	reportedConns map[tcpConnKey]uint64
+
+	// mapEntries holds the number of entries read by the last dump of each
+	// tracked map, by map ID, so that usage is reported without walking the
+	// maps again
+	entriesMu  sync.Mutex
+	mapEntries map[uint32]uint32
+
+	filterMu sync.Mutex
+	filter   FilterConfig
+
+	samplingMu sync.Mutex
+	sampling   sampling
 }
 
+// Packet directions, matching DIR_INGRESS and DIR_EGRESS in monitor.c
+const (
+	DirectionIngress uint8 = 0
+	DirectionEgress  uint8 = 1
+)
+
+// ConnInfo is the 5-tuple and direction of a flow, decoded from
+// struct flow_key in monitor.c.
 type ConnInfo struct {
-	SrcIP    uint32
-	DstIP    uint32
-	SrcPort  uint16
-	DstPort  uint16
-	Protocol uint8
+	SrcIP     netip.Addr
+	DstIP     netip.Addr
+	SrcPort   uint16
+	DstPort   uint16
+	Protocol  uint8
+	Direction uint8
 }
 
 func (c *ConnInfo) UnmarshalBinary(data []byte) error {
-	if len(data) < 13 {
+	if len(data) < 38 {
 		return errors.New("not enough data")
 	}
-	c.SrcIP = binary.LittleEndian.Uint32(data[0:4])
-	c.DstIP = binary.LittleEndian.Uint32(data[4:8])
-	c.SrcPort = binary.BigEndian.Uint16(data[8:10])
-	c.DstPort = binary.BigEndian.Uint16(data[10:12])
-	c.Protocol = data[12]
+	c.SrcIP = addrFrom16(data[0:16])
+	c.DstIP = addrFrom16(data[16:32])
+	c.SrcPort = binary.BigEndian.Uint16(data[32:34])
+	c.DstPort = binary.BigEndian.Uint16(data[34:36])
+	c.Protocol = data[36]
+	c.Direction = data[37]
 	return nil
 }
 
+// addrFrom16 converts a 16-byte map address, unmapping IPv4-mapped addresses
+// so IPv4 traffic is reported in its usual dotted form.
+func addrFrom16(b []byte) netip.Addr {
+	return netip.AddrFrom16([16]byte(b)).Unmap()
+}
+
 type Connection struct {
-	SourceIP string
-	DestIP   string
+	SourceIP netip.Addr
+	DestIP   netip.Addr
 }
 
 type ConnectionInfo struct {
-	SourceIP        string
-	DestIP          string
+	SourceIP        netip.Addr
+	DestIP          netip.Addr
 	SourcePort      uint16
 	DestPort        uint16
 	Protocol        uint8
+	Direction       uint8
 	SourceName      string
 	SourceNamespace string
 	DestName        string
 	DestNamespace   string
+	// Service attribution for the destination, set when it is a ClusterIP
+	// or a Service backend.
+	Service               string
+	ServiceNamespace      string
+	ServicePortName       string
+	BackendPod            string
+	ServiceReadyEndpoints int
 }
 
+// PacketStats aggregates every flow between two addresses.
 type PacketStats struct {
-	Source      string
-	Destination string
+	Source      netip.Addr
+	Destination netip.Addr
 	Protocol    string
-	Size        uint64
-	Count       uint64
-	Latency     uint64
-	Bytes       uint64
+	// Size is the average packet size in bytes.
+	Size  uint64
+	Count uint64
+	// Latency is the average RTT measured between the pair, in either
+	// direction, in nanoseconds.
+	Latency uint64
+	Bytes   uint64
+	// FirstSeen and LastSeen span the packets of every aggregated flow.
+	FirstSeen time.Time
+	LastSeen  time.Time
 }
 
 type ConnectionStats struct {
-	Source      string
-	Destination string
-	State       string
-	Count       uint64
-	Protocol    string
-	SourcePort  uint16
-	DestPort    uint16
+	Source                netip.Addr
+	Destination           netip.Addr
+	State                 string
+	Count                 uint64
+	Bytes                 uint64
+	FirstSeen             time.Time
+	LastSeen              time.Time
+	TCPFlags              uint8
+	Protocol              string
+	SourcePort            uint16
+	DestPort              uint16
+	Direction             string
+	Service               string
+	ServiceNamespace      string
+	ServicePortName       string
+	BackendPod            string
+	ServiceReadyEndpoints int
+	Tunnel                Tunnel
 }
 
-func NewCollector() (*Collector, error) {
+func NewCollector(config Config, kubeClient *kubernetes.Client) (*Collector, error) {
+	features := ProbeFeatures()
+	log.Printf("Kernel eBPF features: %s", features)
+
 	// Load pre-compiled eBPF program
 	spec, err := ebpf.LoadCollectionSpec("ebpf/monitor.o")
 	if err != nil {
 		return nil, fmt.Errorf("failed to load eBPF program: %v", err)
 	}
 
+	for name, size := range config.MapSizes {
+		m, ok := spec.Maps[name]
+		if !ok {
+			return nil, fmt.Errorf("cannot resize unknown map %q", name)
+		}
+		m.MaxEntries = size
+	}
+
+	if config.DataRTT {
+		enabled, ok := spec.Variables["data_rtt_enabled"]
+		if !ok {
+			return nil, errors.New("eBPF program has no data_rtt_enabled variable")
+		}
+		if err := enabled.Set(uint8(1)); err != nil {
+			return nil, fmt.Errorf("failed to enable data RTT sampling: %v", err)
+		}
+	}
+
+	for name, port := range map[string]uint16{"vxlan_port": config.VXLANPort, "geneve_port": config.GenevePort} {
+		if port == 0 {
+			continue
+		}
+		v, ok := spec.Variables[name]
+		if !ok {
+			return nil, fmt.Errorf("eBPF program has no %s variable", name)
+		}
+		if err := v.Set(port); err != nil {
+			return nil, fmt.Errorf("failed to set %s: %v", name, err)
+		}
+	}
+
+	if config.Events {
+		if !features.RingBuf {
+			return nil, errors.New("the event stream requires BPF ring buffers (Linux 5.8 or later)")
+		}
+		enabled, ok := spec.Variables["events_enabled"]
+		if !ok {
+			return nil, errors.New("eBPF program has no events_enabled variable")
+		}
+		if err := enabled.Set(uint8(1)); err != nil {
+			return nil, fmt.Errorf("failed to enable events: %v", err)
+		}
+	}
+
 	var objs struct {
 		MonitorPackets *ebpf.Program `ebpf:"monitor_packets"`
-		PacketCount    *ebpf.Map     `ebpf:"packet_count"`
+		TCIngress      *ebpf.Program `ebpf:"monitor_tc_ingress"`
+		TCEgress       *ebpf.Program `ebpf:"monitor_tc_egress"`
+		FlowMap        *ebpf.Map     `ebpf:"flow_map"`
 		LatencyMap     *ebpf.Map     `ebpf:"latency_map"`
 		DropMap        *ebpf.Map     `ebpf:"drop_map"`
-		PacketSize     *ebpf.Map     `ebpf:"packet_size"`
-		ConnectionMap  *ebpf.Map     `ebpf:"connection_map"`
 		ProtocolCount  *ebpf.Map     `ebpf:"protocol_count"`
+		TCPConnMap     *ebpf.Map     `ebpf:"tcp_conn_map"`
+		TCPEvents      *ebpf.Map     `ebpf:"tcp_events"`
+		MapErrors      *ebpf.Map     `ebpf:"map_errors"`
+		RetransmitMap  *ebpf.Map     `ebpf:"retransmit_map"`
+		ICMPMap        *ebpf.Map     `ebpf:"icmp_map"`
+		SizeHist       *ebpf.Map     `ebpf:"size_hist"`
+		RTTHist        *ebpf.Map     `ebpf:"rtt_hist"`
+		CIDRFilter     *ebpf.Map     `ebpf:"cidr_filter"`
+		PortFilter     *ebpf.Map     `ebpf:"port_filter"`
+		FilterConfig   *ebpf.Map     `ebpf:"filter_config"`
+		SampleRates    *ebpf.Map     `ebpf:"sample_rates"`
+		SkipDecap      *ebpf.Map     `ebpf:"skip_decapsulated"`
+		Events         *ebpf.Map     `ebpf:"events"`
 	}
 
-	if err := spec.LoadAndAssign(&objs, nil); err != nil {
+	opts := &ebpf.CollectionOptions{}
+	var layout string
+	if config.PinPath != "" {
+		pinMaps(spec)
+		layout = mapLayout(spec)
+		mapPins := filepath.Join(config.PinPath, mapPinDir, layout)
+		if err := os.MkdirAll(mapPins, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create pin directory: %v", err)
+		}
+		opts.Maps.PinPath = mapPins
+	}
+	if err := loadObjects(spec, &objs, opts); err != nil {
 		return nil, fmt.Errorf("failed to load eBPF objects: %v", err)
 	}
+	if layout != "" {
+		removeOtherLayouts(config.PinPath, layout)
+	}
 
-	kubeClient, err := kubernetes.NewClient()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Kubernetes client: %v", err)
-	}
-
-	return &Collector{
-		program:          objs.MonitorPackets,
-		packetCountMap:   objs.PacketCount,
-		latencyMap:       objs.LatencyMap,
-		dropMap:          objs.DropMap,
-		packetSizeMap:    objs.PacketSize,
-		connectionMap:    objs.ConnectionMap,
-		protocolCountMap: objs.ProtocolCount,
-		kubeClient:       kubeClient,
-	}, nil
-}
-
-func (c *Collector) GetPacketCounts() (map[string]map[string]uint64, error) {
-	counts := make(map[string]map[string]uint64)
-	var key struct{ SrcIP, DstIP uint32 }
-	var value uint64
-
-	entries := c.packetCountMap.Iterate()
-	for entries.Next(&key, &value) {
-		srcIP := int2ip(key.SrcIP).String()
-		dstIP := int2ip(key.DstIP).String()
-		if _, ok := counts[srcIP]; !ok {
-			counts[srcIP] = make(map[string]uint64)
+	var kfreeSkb *ebpf.Program
+	if config.DropReasons {
+		if features.BTFTracing && features.DropReasons {
+			kfreeSkb, err = loadDropProgram(spec, map[string]*ebpf.Map{
+				"drop_map":   objs.DropMap,
+				"map_errors": objs.MapErrors,
+				"events":     objs.Events,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to load kfree_skb program: %v", err)
+			}
+		} else {
+			log.Println("Kernel drop reasons are not available, packet drops will not be reported")
 		}
-		counts[srcIP][dstIP] = value
 	}
 
-	return counts, nil
-}
-
-func int2ip(nn uint32) net.IP {
-	ip := make(net.IP, 4)
-	binary.LittleEndian.PutUint32(ip, nn)
-	return ip
-}
-
-func (c *Collector) GetPacketSizes() (map[string]map[string]uint64, error) {
-	sizes := make(map[string]map[string]uint64)
-	var key struct{ SrcIP, DstIP uint32 }
-	var value uint64
-
-	entries := c.packetSizeMap.Iterate()
-	for entries.Next(&key, &value) {
-		srcIP := int2ip(key.SrcIP).String()
-		dstIP := int2ip(key.DstIP).String()
-		if _, ok := sizes[srcIP]; !ok {
-			sizes[srcIP] = make(map[string]uint64)
+	var retransmitSkb, retransmitSynack *ebpf.Program
+	if config.Retransmits {
+		if features.BTFTracing {
+			retransmitSkb, retransmitSynack, err = loadRetransmitPrograms(spec, map[string]*ebpf.Map{
+				"retransmit_map": objs.RetransmitMap,
+				"map_errors":     objs.MapErrors,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to load TCP retransmission programs: %v", err)
+			}
+		} else {
+			log.Println("BTF tracepoints are not available, TCP retransmissions will not be reported")
 		}
-		sizes[srcIP][dstIP] = value
 	}
 
-	return sizes, nil
+	c := &Collector{
+		program:             objs.MonitorPackets,
+		tcIngress:           objs.TCIngress,
+		tcEgress:            objs.TCEgress,
+		kfreeSkb:            kfreeSkb,
+		tcpRetransmitSkb:    retransmitSkb,
+		tcpRetransmitSynack: retransmitSynack,
+		flowMap:             objs.FlowMap,
+		latencyMap:          objs.LatencyMap,
+		dropMap:             objs.DropMap,
+		protocolCountMap:    objs.ProtocolCount,
+		tcpConnMap:          objs.TCPConnMap,
+		tcpEventsMap:        objs.TCPEvents,
+		mapErrorsMap:        objs.MapErrors,
+		retransmitMap:       objs.RetransmitMap,
+		icmpMap:             objs.ICMPMap,
+		sizeHistMap:         objs.SizeHist,
+		rttHistMap:          objs.RTTHist,
+		cidrFilterMap:       objs.CIDRFilter,
+		portFilterMap:       objs.PortFilter,
+		filterConfigMap:     objs.FilterConfig,
+		sampleRatesMap:      objs.SampleRates,
+		skipDecapMap:        objs.SkipDecap,
+		eventsMap:           objs.Events,
+		kubeClient:          kubeClient,
+		config:              config,
+		features:            features,
+		attachments:         make(map[int]*attachment),
+		sampling:            sampling{ifaces: make(map[int]uint32), factor: 1},
+	}
+	if kfreeSkb != nil {
+		if c.dropReasons, err = loadDropReasons(); err != nil {
+			log.Printf("Failed to read drop reasons from kernel BTF, drops will be reported by number: %v", err)
+		}
+	}
+	if err := c.SetFilter(config.Filter); err != nil {
+		return nil, fmt.Errorf("failed to set filter: %v", err)
+	}
+	if err := c.SetSampleRate(config.SampleRate); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-func (c *Collector) GetConnections() (map[ConnectionInfo]uint64, error) {
-	connections := make(map[ConnectionInfo]uint64)
-	var key ConnInfo
-	var value uint64
+// GetConnections returns every flow, attributed to Kubernetes resources.
+func (c *Collector) GetConnections() (map[ConnectionInfo]Flow, error) {
+	flows, err := c.GetFlows()
+	if err != nil {
+		return nil, err
+	}
+	return c.attributeFlows(flows), nil
+}
 
-	entries := c.connectionMap.Iterate()
-	for entries.Next(&key, &value) {
-		srcIP := int2ip(key.SrcIP).String()
-		dstIP := int2ip(key.DstIP).String()
+func (c *Collector) attributeFlows(flows []Flow) map[ConnectionInfo]Flow {
+	connections := make(map[ConnectionInfo]Flow, len(flows))
+	for _, flow := range flows {
+		key := flow.ConnInfo
+		srcIP := key.SrcIP.String()
+		dstIP := key.DstIP.String()
 
-		// Look up pod or service for source IP
-		srcName, srcNamespace, _ := c.kubeClient.GetPodByIP(srcIP)
+		// Look up the pod that held each IP when the flow was last seen, as
+		// the IP may have been reused since, or else the service
+		srcName, srcNamespace, _ := c.kubeClient.GetPodByIPAt(srcIP, flow.LastSeen)
 		if srcName == "" {
 			srcName, srcNamespace, _ = c.kubeClient.GetServiceByIP(srcIP)
 		}
 
-		// Look up pod or service for destination IP
-		dstName, dstNamespace, _ := c.kubeClient.GetPodByIP(dstIP)
+		dstName, dstNamespace, _ := c.kubeClient.GetPodByIPAt(dstIP, flow.LastSeen)
 		if dstName == "" {
 			dstName, dstNamespace, _ = c.kubeClient.GetServiceByIP(dstIP)
 		}
 
+		// UnmarshalBinary already decodes the ports from network byte order
 		connInfo := ConnectionInfo{
-			SourceIP:        srcIP,
-			DestIP:          dstIP,
-			SourcePort:      ntohs(key.SrcPort),
-			DestPort:        ntohs(key.DstPort),
+			SourceIP:        key.SrcIP,
+			DestIP:          key.DstIP,
+			SourcePort:      key.SrcPort,
+			DestPort:        key.DstPort,
 			Protocol:        key.Protocol,
+			Direction:       key.Direction,
 			SourceName:      srcName,
 			SourceNamespace: srcNamespace,
 			DestName:        dstName,
 			DestNamespace:   dstNamespace,
 		}
-		connections[connInfo] = value
-	}
-	if entries.Err() != nil {
-		log.Printf("Error iterating connection_map: %v", entries.Err())
-	}
-	return connections, nil
-}
 
-func ntohs(n uint16) uint16 {
-	return (n<<8)&0xff00 | (n>>8)&0x00ff
-}
-
-func (c *Collector) GetProtocolCounts() (map[string]uint64, error) {
-	counts := make(map[string]uint64)
-	var value uint64
-
-	if err := c.protocolCountMap.Lookup(uint32(0), &value); err == nil {
-		counts["TCP"] = value
-	}
-	if err := c.protocolCountMap.Lookup(uint32(1), &value); err == nil {
-		counts["UDP"] = value
+		// Attribute the destination to a Service and, where possible, the backend pod
+		if backend, ok := c.kubeClient.ResolveServiceBackend(dstIP, connInfo.DestPort); ok {
+			connInfo.Service = backend.Service
+			connInfo.ServiceNamespace = backend.Namespace
+			connInfo.ServicePortName = backend.PortName
+			connInfo.BackendPod = backend.BackendPod
+			connInfo.ServiceReadyEndpoints = backend.ReadyEndpoints
+		}
+		connections[connInfo] = flow
 	}
-
-	return counts, nil
+	return connections
 }
 
-func (c *Collector) GetLatencies() (map[string]map[string]uint64, error) {
-	latencies := make(map[string]map[string]uint64)
-	var key struct{ SrcIP, DstIP uint32 }
-	var value struct {
-		TotalLatency uint64
-		PacketCount  uint64
+// Stop detaches the eBPF program from every interface it is attached to
+func (c *Collector) Stop() error {
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
 	}
 
-	entries := c.latencyMap.Iterate()
-	for entries.Next(&key, &value) {
-		srcIP := int2ip(key.SrcIP).String()
-		dstIP := int2ip(key.DstIP).String()
-		if _, ok := latencies[srcIP]; !ok {
-			latencies[srcIP] = make(map[string]uint64)
+	c.mu.Lock()
+	attachments := c.attachments
+	c.attachments = nil
+	events := c.events
+	tracing := c.tracing
+	c.tracing = nil
+	c.mu.Unlock()
+
+	var errs []error
+	if tracing != nil {
+		if err := tracing.Release(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to detach tracepoint program: %v", err))
 		}
-		// latencies[srcIP][dstIP] = value // Store latency in nanoseconds / 1000000 // Convert ns to ms
-		if value.PacketCount > 0 {
-			avgLatency := value.TotalLatency / value.PacketCount
-			latencies[srcIP][dstIP] = avgLatency
+	}
+	if events != nil {
+		if err := events.close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close events ring buffer: %v", err))
 		}
 	}
-
-	return latencies, nil
+	// Pinned links stay attached for the next run to take over
+	for _, a := range attachments {
+		if err := a.Release(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to detach from %s: %v", a.name, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (c *Collector) GetPacketDrops() (map[string]uint64, error) {
-	drops := make(map[string]uint64)
-	var key uint32
-	var value uint64
-
-	entries := c.dropMap.Iterate()
-	for entries.Next(&key, &value) {
-		reason := getDropReason(key)
-		drops[reason] = value
+// GetPacketStats aggregates the flows of each source and destination pair
+// across ports, protocols and directions.
+func (c *Collector) GetPacketStats() ([]PacketStats, error) {
+	snapshot, err := c.Snapshot()
+	if err != nil {
+		return nil, err
 	}
-
-	return drops, nil
+	return snapshot.PacketStats(), nil
 }
 
-func getDropReason(code uint32) string {
-	reasons := map[uint32]string{
-		1: "Generic drop",
-		2: "Invalid IP header",
-		3: "TCP checksum error",
-		4: "UDP checksum error",
-	}
-	if reason, ok := reasons[code]; ok {
-		return reason
+func (c *Collector) GetConnectionStats() ([]ConnectionStats, error) {
+	snapshot, err := c.Snapshot()
+	if err != nil {
+		return nil, err
 	}
-	return fmt.Sprintf("Unknown (%d)", code)
+	return c.ConnectionStats(snapshot), nil
 }
 
-// Stop detaches the eBPF program from the network interface
-func (c *Collector) Stop() error {
-	if c.link != nil {
-		return c.link.Close()
+func determineConnectionState(connInfo ConnectionInfo, tcpStates map[tcpTuple]uint8) string {
+	if connInfo.Protocol != 6 { // TCP
+		return "ACTIVE"
 	}
-	return nil
+	state, ok := lookupTCPState(tcpStates, connInfo)
+	if !ok {
+		return "UNKNOWN"
+	}
+	return tcpStateToString(state)
 }
 
-func (c *Collector) GetPacketStats() ([]PacketStats, error) {
-	var stats []PacketStats
-
-	// Get all required metrics
-	packetCounts, err := c.GetPacketCounts()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get packet counts: %v", err)
+func directionToString(direction uint8) string {
+	if direction == DirectionEgress {
+		return "egress"
 	}
+	return "ingress"
+}
 
-	packetSizes, err := c.GetPacketSizes()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get packet sizes: %v", err)
+// Start attaches the eBPF program to the configured network interfaces
+func (c *Collector) Start() error {
+	if len(c.config.Interfaces) == 0 {
+		return errors.New("no interfaces configured")
 	}
 
-	latencies, err := c.GetLatencies()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get latencies: %v", err)
-	}
-
-	// Aggregate metrics
-	for srcIP, dests := range packetCounts {
-		for dstIP, count := range dests {
-			stat := PacketStats{
-				Source:      srcIP,
-				Destination: dstIP,
-				Count:       count,
-				Size:        packetSizes[srcIP][dstIP],
-				Latency:     latencies[srcIP][dstIP],
-				Bytes:       packetSizes[srcIP][dstIP] * count,
-			}
-			stats = append(stats, stat)
+	c.done = make(chan struct{})
+
+	// Subscribe before listing so no interface created in between is missed
+	var updates chan netlink.LinkUpdate
+	if c.config.DiscoverInterfaces {
+		updates = make(chan netlink.LinkUpdate, 64)
+		err := netlink.LinkSubscribeWithOptions(updates, c.done, netlink.LinkSubscribeOptions{
+			ErrorCallback: func(err error) {
+				log.Printf("Interface watch error: %v", err)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to link updates: %v", err)
 		}
 	}
 
-	return stats, nil
-}
-
-func (c *Collector) GetConnectionStats() ([]ConnectionStats, error) {
-	var stats []ConnectionStats
-
-	connections, err := c.GetConnections()
+	attached, err := c.attachExisting()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get connections: %v", err)
-	}
-
-	for connInfo, count := range connections {
-		stat := ConnectionStats{
-			Source:      connInfo.SourceIP,
-			Destination: connInfo.DestIP,
-			SourcePort:  connInfo.SourcePort,
-			DestPort:    connInfo.DestPort,
-			Protocol:    protocolToString(connInfo.Protocol),
-			Count:       count,
-			State:       determineConnectionState(connInfo),
-		}
-		stats = append(stats, stat)
+		return err
 	}
-
-	return stats, nil
-}
-
-func determineConnectionState(connInfo ConnectionInfo) string {
-	// Basic state determination based on protocol
-	// You can enhance this based on your needs
-	if connInfo.Protocol == 6 { // TCP
-		return "ESTABLISHED" // Simplified - you might want to track actual TCP states
+	if attached == 0 && !c.config.DiscoverInterfaces {
+		return fmt.Errorf("no interface matching %v could be attached", c.config.Interfaces)
 	}
-	return "ACTIVE" // For UDP and others
-}
 
-func protocolToString(protocol uint8) string {
-	switch protocol {
-	case 6:
-		return "TCP"
-	case 17:
-		return "UDP"
-	default:
-		return fmt.Sprintf("UNKNOWN(%d)", protocol)
+	if err := c.attachTracing(); err != nil {
+		return err
 	}
-}
+	c.sweepLinkPins()
 
-// Start attaches the eBPF program to the network interface
-func (c *Collector) Start() error {
-	iface, err := netlink.LinkByName("eth0") // Change to your interface name
-	if err != nil {
-		return fmt.Errorf("failed to get interface: %v", err)
+	if updates != nil {
+		go c.watchInterfaces(updates)
 	}
-
-	l, err := link.AttachXDP(link.XDPOptions{
-		Program:   c.program,
-		Interface: iface.Attrs().Index,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to attach XDP program: %v", err)
+	if c.config.FlowIdleTimeout > 0 {
+		go c.runFlowGC(c.done)
 	}
-
-	c.link = l
-	log.Println("eBPF program attached successfully")
+	if c.config.AdaptiveSampling != nil {
+		go c.runAdaptiveSampling(c.done)
+	}
+	log.Printf("eBPF program attached to %d interface(s)", attached)
 	return nil
 }
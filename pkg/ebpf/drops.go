@@ -0,0 +1,137 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// dropKey mirrors struct drop_key in monitor.c.
+type dropKey struct {
+	SrcIP    [16]byte
+	DstIP    [16]byte
+	SrcPort  [2]byte
+	DstPort  [2]byte
+	Protocol uint8
+	_        [3]uint8
+	Reason   uint32
+	Netns    uint32
+}
+
+// DropStats counts the packets the kernel dropped for one reason, tuple and
+// network namespace. Addresses are unspecified when the packet was dropped
+// before its network header was parsed.
+type DropStats struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	SourcePort  uint16
+	DestPort    uint16
+	Protocol    uint8
+	// Reason is the name of the kernel's skb_drop_reason, such as
+	// "NO_SOCKET" or "NETFILTER_DROP".
+	Reason string
+	// Netns is the inode number of the network namespace the packet was
+	// dropped in.
+	Netns uint32
+	// Count is cumulative since the entry was created.
+	Count uint64
+}
+
+// GetDrops returns every drop recorded by the kfree_skb tracepoint.
+func (c *Collector) GetDrops() ([]DropStats, error) {
+	dump, err := dumpMap[dropKey, uint64](c.dropMap, c.features.BatchOps, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read drop_map: %v", err)
+	}
+	c.recordEntries(mapIDDrop, len(dump.Keys))
+
+	drops := make([]DropStats, len(dump.Keys))
+	for i, key := range dump.Keys {
+		drops[i] = DropStats{
+			Source:      addrFrom16(key.SrcIP[:]),
+			Destination: addrFrom16(key.DstIP[:]),
+			SourcePort:  binary.BigEndian.Uint16(key.SrcPort[:]),
+			DestPort:    binary.BigEndian.Uint16(key.DstPort[:]),
+			Protocol:    key.Protocol,
+			Reason:      c.DropReasonName(key.Reason),
+			Netns:       key.Netns,
+			Count:       sumPerCPU(dump.PerCPU(i)),
+		}
+	}
+	return drops, nil
+}
+
+// GetPacketDrops returns the drops per reason.
+func (c *Collector) GetPacketDrops() (map[string]uint64, error) {
+	drops, err := c.GetDrops()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]uint64)
+	for _, drop := range drops {
+		counts[drop.Reason] += drop.Count
+	}
+	return counts, nil
+}
+
+// DropReasonName names a kernel skb_drop_reason value.
+func (c *Collector) DropReasonName(code uint32) string {
+	if name, ok := c.dropReasons[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", code)
+}
+
+// loadDropReasons reads the names of enum skb_drop_reason from the kernel's
+// BTF, since the values change between kernel versions. The kfree_skb
+// program is only loaded when that enum exists.
+func loadDropReasons() (map[uint32]string, error) {
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		return nil, err
+	}
+	var enum *btf.Enum
+	if err := spec.TypeByName("skb_drop_reason", &enum); err != nil {
+		return nil, err
+	}
+	reasons := make(map[uint32]string, len(enum.Values))
+	for _, v := range enum.Values {
+		name := strings.TrimPrefix(v.Name, "SKB_DROP_REASON_")
+		reasons[uint32(v.Value)] = strings.TrimPrefix(name, "SKB_")
+	}
+	return reasons, nil
+}
+
+// haveDropReasons checks that the kernel passes a drop reason to the
+// kfree_skb tracepoint.
+func haveDropReasons() error {
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		return err
+	}
+	var enum *btf.Enum
+	if err := spec.TypeByName("skb_drop_reason", &enum); err != nil {
+		if errors.Is(err, btf.ErrNotFound) {
+			return fmt.Errorf("kernel has no skb_drop_reason: %w", ebpf.ErrNotSupported)
+		}
+		return err
+	}
+	return nil
+}
+
+// loadDropProgram loads the kfree_skb program on its own, sharing the maps
+// of the main collection.
+func loadDropProgram(spec *ebpf.CollectionSpec, maps map[string]*ebpf.Map) (*ebpf.Program, error) {
+	var objs struct {
+		OnKfreeSkb *ebpf.Program `ebpf:"on_kfree_skb"`
+	}
+	if err := spec.LoadAndAssign(&objs, &ebpf.CollectionOptions{MapReplacements: maps}); err != nil {
+		return nil, err
+	}
+	return objs.OnKfreeSkb, nil
+}
@@ -0,0 +1,241 @@
+package ebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// EventType identifies an event, matching EVENT_* in monitor.c.
+type EventType uint8
+
+const (
+	EventFlowStart EventType = 1
+	EventFlowEnd   EventType = 2
+	EventTCPReset  EventType = 3
+	EventDrop      EventType = 4
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventFlowStart:
+		return "flow_start"
+	case EventFlowEnd:
+		return "flow_end"
+	case EventTCPReset:
+		return "tcp_reset"
+	case EventDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// Event is a flow lifecycle or drop event read from the events ring buffer.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Flow is the tuple of the dropped packet for EventDrop, without a
+	// direction. Its addresses are unspecified (::) when the kernel dropped
+	// the packet before its network header was set.
+	Flow     ConnInfo
+	TCPFlags uint8
+	// Reason is the kernel's skb_drop_reason for EventDrop, named by
+	// DropReasonName. For EventFlowEnd it is the final TCP state, or zero
+	// when the flow expired idle.
+	Reason uint32
+	// Packets and Bytes are those of the first packet for EventFlowStart and
+	// the final counters for idle flows expired by the collector.
+	Packets uint64
+	Bytes   uint64
+}
+
+// flowEvent mirrors struct flow_event in monitor.c.
+type flowEvent struct {
+	Timestamp uint64
+	Flow      flowKey
+	Type      uint8
+	TCPFlags  uint8
+	_         [2]uint8
+	Reason    uint32
+	Packets   uint64
+	Bytes     uint64
+}
+
+// EventLoss counts events that never reached the channel.
+type EventLoss struct {
+	// Kernel counts events dropped because the ring buffer was full, which
+	// happens when the consumer of the channel falls behind.
+	Kernel uint64
+	// Userspace counts idle flow ends discarded because the channel was
+	// full, since flow expiry must not wait for the consumer.
+	Userspace uint64
+}
+
+type eventStream struct {
+	reader *ringbuf.Reader
+	events chan Event
+	done   chan struct{}
+
+	// mu guards sends from other goroutines against the channel closing
+	mu     sync.Mutex
+	closed bool
+	lost   atomic.Uint64
+}
+
+// Events starts reading the events ring buffer and returns the channel the
+// events are delivered on, with room for buffer events. Delivery blocks
+// when the channel is full, so that a slow consumer makes the kernel drop
+// events rather than the collector buffering without bound; drops are
+// reported by LostEvents. The channel is closed by Stop.
+func (c *Collector) Events(buffer int) (<-chan Event, error) {
+	if !c.config.Events {
+		return nil, errors.New("event stream is disabled in the config")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.events != nil {
+		return nil, errors.New("event stream already started")
+	}
+
+	clock, err := newKtimeClock()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := ringbuf.NewReader(c.eventsMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open events ring buffer: %v", err)
+	}
+	s := &eventStream{
+		reader: reader,
+		events: make(chan Event, buffer),
+		done:   make(chan struct{}),
+	}
+	c.events = s
+	go s.run(clock)
+	return s.events, nil
+}
+
+// clockReanchorInterval is how often the event stream reads the clocks again
+// to convert event timestamps.
+const clockReanchorInterval = time.Minute
+
+// run delivers events until the ring buffer is closed. Timestamps are
+// converted with clock, anchored again every clockReanchorInterval.
+func (s *eventStream) run(clock ktimeClock) {
+	defer func() {
+		s.mu.Lock()
+		s.closed = true
+		close(s.events)
+		s.mu.Unlock()
+	}()
+
+	var record ringbuf.Record
+	for {
+		if err := s.reader.ReadInto(&record); err != nil {
+			if !errors.Is(err, ringbuf.ErrClosed) {
+				log.Printf("Failed to read events ring buffer: %v", err)
+			}
+			return
+		}
+		// Wall-clock time drifts from the monotonic clock, for example
+		// when NTP steps it, so the clock is anchored again now and then
+		if time.Since(clock.wall) > clockReanchorInterval {
+			if anchored, err := newKtimeClock(); err == nil {
+				clock = anchored
+			}
+		}
+		event, err := decodeEvent(record.RawSample, clock)
+		if err != nil {
+			log.Printf("Failed to decode event: %v", err)
+			continue
+		}
+		select {
+		case s.events <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// publish delivers an event generated in userspace without blocking.
+func (s *eventStream) publish(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+		s.lost.Add(1)
+	}
+}
+
+func (s *eventStream) close() error {
+	close(s.done)
+	return s.reader.Close()
+}
+
+func decodeEvent(sample []byte, clock ktimeClock) (Event, error) {
+	var raw flowEvent
+	if err := binary.Read(bytes.NewReader(sample), binary.NativeEndian, &raw); err != nil {
+		return Event{}, err
+	}
+	event := Event{
+		Type:     EventType(raw.Type),
+		Time:     clock.Time(raw.Timestamp),
+		TCPFlags: raw.TCPFlags,
+		Reason:   raw.Reason,
+		Packets:  raw.Packets,
+		Bytes:    raw.Bytes,
+		Flow:     raw.Flow.connInfo(),
+	}
+	return event, nil
+}
+
+// publishFlowEnds reports flows expired by the collector on the event
+// stream, if one is running.
+func (c *Collector) publishFlowEnds(flows []Flow) {
+	c.mu.Lock()
+	s := c.events
+	c.mu.Unlock()
+	if s == nil {
+		return
+	}
+	for _, flow := range flows {
+		s.publish(Event{
+			Type:     EventFlowEnd,
+			Time:     flow.LastSeen,
+			Flow:     flow.ConnInfo,
+			TCPFlags: flow.TCPFlags,
+			Packets:  flow.Packets,
+			Bytes:    flow.Bytes,
+		})
+	}
+}
+
+// LostEvents returns the events lost since the program was loaded.
+func (c *Collector) LostEvents() (EventLoss, error) {
+	var loss EventLoss
+	var values []uint64
+	if err := c.mapErrorsMap.Lookup(mapIDEvents, &values); err != nil {
+		return loss, fmt.Errorf("failed to read lost events: %v", err)
+	}
+	loss.Kernel = sumPerCPU(values)
+
+	c.mu.Lock()
+	if c.events != nil {
+		loss.Userspace = c.events.lost.Load()
+	}
+	c.mu.Unlock()
+	return loss, nil
+}
@@ -0,0 +1,75 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
+)
+
+// KernelFeatures records which eBPF capabilities the running kernel offers.
+type KernelFeatures struct {
+	XDP          bool
+	SchedCLS     bool
+	BoundedLoops bool
+	BatchOps     bool
+	RingBuf      bool
+	BTFTracing   bool
+	DropReasons  bool
+}
+
+func (f KernelFeatures) String() string {
+	return fmt.Sprintf("xdp=%t sched_cls=%t bounded_loops=%t batch_ops=%t ringbuf=%t btf_tracing=%t drop_reasons=%t", f.XDP, f.SchedCLS, f.BoundedLoops, f.BatchOps, f.RingBuf, f.BTFTracing, f.DropReasons)
+}
+
+// ProbeFeatures probes the kernel using the cilium/ebpf features package.
+func ProbeFeatures() KernelFeatures {
+	return KernelFeatures{
+		XDP:          probe("XDP program type", features.HaveProgramType(ebpf.XDP)),
+		SchedCLS:     probe("sched_cls program type", features.HaveProgramType(ebpf.SchedCLS)),
+		BoundedLoops: probe("bounded loops", features.HaveBoundedLoops()),
+		BatchOps:     probe("batch map operations", haveBatchOps()),
+		RingBuf:      probe("ring buffer map type", features.HaveMapType(ebpf.RingBuf)),
+		BTFTracing:   probe("BTF tracepoints", haveBTFTracing()),
+		DropReasons:  probe("kfree_skb drop reasons", haveDropReasons()),
+	}
+}
+
+// haveBatchOps looks up a batch in an empty hash map, which fails with
+// ErrKeyNotExist only when the kernel implements batch operations.
+func haveBatchOps() error {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+	})
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	var cursor ebpf.MapBatchCursor
+	keys := make([]uint32, 1)
+	values := make([]uint32, 1)
+	_, err = m.BatchLookup(&cursor, keys, values, nil)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil
+	}
+	if err == nil {
+		return errors.New("batch lookup of an empty map returned no error")
+	}
+	return err
+}
+
+func probe(name string, err error) bool {
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, ebpf.ErrNotSupported) {
+		log.Printf("Failed to probe %s: %v", name, err)
+	}
+	return false
+}
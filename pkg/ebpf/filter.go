@@ -0,0 +1,170 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/cilium/ebpf"
+)
+
+// Actions of cidr_filter entries, matching FILTER_* in monitor.c
+const (
+	filterInclude uint8 = 1
+	filterExclude uint8 = 2
+)
+
+// filter_config flags, matching FILTER_F_* in monitor.c
+const (
+	filterFlagInclude uint32 = 1 << iota
+	filterFlagExclude
+	filterFlagPorts
+)
+
+// FilterConfig selects the traffic the datapath records, so that uninteresting
+// traffic never takes up map entries. The most specific CIDR covering an
+// address decides whether it is included or excluded. Filters apply to the
+// inner addresses and ports of tunnelled traffic.
+type FilterConfig struct {
+	// IncludeCIDRs, when set, records only packets with at least one address
+	// in these CIDRs, such as the pod CIDR.
+	IncludeCIDRs []netip.Prefix `json:"include_cidrs,omitempty"`
+	// ExcludeCIDRs skips packets with either address in these CIDRs. A more
+	// specific exclusion carves a range out of an inclusion and vice versa.
+	ExcludeCIDRs []netip.Prefix `json:"exclude_cidrs,omitempty"`
+	// Ports, when set, records only packets with a source or destination
+	// port in the list. Packets without ports, such as ICMP, are recorded.
+	Ports []uint16 `json:"ports,omitempty"`
+}
+
+// lpmKey mirrors struct lpm_key in monitor.c.
+type lpmKey struct {
+	PrefixLen uint32
+	Addr      [16]byte
+}
+
+func newLPMKey(p netip.Prefix) lpmKey {
+	bits := p.Bits()
+	if p.Addr().Is4() {
+		bits += 96
+	}
+	return lpmKey{PrefixLen: uint32(bits), Addr: p.Addr().As16()}
+}
+
+func (f FilterConfig) validate() error {
+	seen := make(map[netip.Prefix]bool)
+	for _, p := range slices.Concat(f.IncludeCIDRs, f.ExcludeCIDRs) {
+		if !p.IsValid() {
+			return fmt.Errorf("invalid CIDR %q", p)
+		}
+		if seen[p.Masked()] {
+			return fmt.Errorf("CIDR %s is listed more than once", p.Masked())
+		}
+		seen[p.Masked()] = true
+	}
+	if slices.Contains(f.Ports, 0) {
+		return errors.New("port 0 cannot be filtered on")
+	}
+	return nil
+}
+
+// SetFilter replaces the filters of the datapath while it runs. New rules
+// are written before the flags that enable them and stale rules removed
+// last, so an update never records nothing in between.
+func (c *Collector) SetFilter(f FilterConfig) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	c.filterMu.Lock()
+	defer c.filterMu.Unlock()
+
+	cidrs := make(map[lpmKey]uint8)
+	for _, p := range f.IncludeCIDRs {
+		cidrs[newLPMKey(p.Masked())] = filterInclude
+	}
+	for _, p := range f.ExcludeCIDRs {
+		cidrs[newLPMKey(p.Masked())] = filterExclude
+	}
+	for key, action := range cidrs {
+		if err := c.cidrFilterMap.Put(key, action); err != nil {
+			return fmt.Errorf("failed to add CIDR filter %s: %v", key.prefix(), err)
+		}
+	}
+	ports := make(map[uint16]bool)
+	for _, port := range f.Ports {
+		ports[port] = true
+		if err := c.portFilterMap.Put(port, uint8(1)); err != nil {
+			return fmt.Errorf("failed to add port filter %d: %v", port, err)
+		}
+	}
+
+	var flags uint32
+	if len(f.IncludeCIDRs) > 0 {
+		flags |= filterFlagInclude
+	}
+	if len(f.ExcludeCIDRs) > 0 {
+		flags |= filterFlagExclude
+	}
+	if len(ports) > 0 {
+		flags |= filterFlagPorts
+	}
+	if err := c.filterConfigMap.Put(uint32(0), flags); err != nil {
+		return fmt.Errorf("failed to update filter_config: %v", err)
+	}
+
+	if err := deleteStale(c.cidrFilterMap, func(key lpmKey) bool {
+		_, ok := cidrs[key]
+		return ok
+	}); err != nil {
+		return fmt.Errorf("failed to remove CIDR filters: %v", err)
+	}
+	if err := deleteStale(c.portFilterMap, func(port uint16) bool {
+		return ports[port]
+	}); err != nil {
+		return fmt.Errorf("failed to remove port filters: %v", err)
+	}
+
+	c.filter = f
+	return nil
+}
+
+// Filter returns the filters last set.
+func (c *Collector) Filter() FilterConfig {
+	c.filterMu.Lock()
+	defer c.filterMu.Unlock()
+	return c.filter
+}
+
+func (k lpmKey) prefix() netip.Prefix {
+	addr := netip.AddrFrom16(k.Addr)
+	bits := int(k.PrefixLen)
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+		bits -= 96
+	}
+	return netip.PrefixFrom(addr, bits)
+}
+
+// deleteStale removes the keys of m that keep rejects.
+func deleteStale[K comparable](m *ebpf.Map, keep func(K) bool) error {
+	var stale []K
+	var key K
+	iter := m.Iterate()
+	var value []byte
+	for iter.Next(&key, &value) {
+		if !keep(key) {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	return nil
+}
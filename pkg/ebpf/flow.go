@@ -0,0 +1,113 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// flowStats mirrors struct flow_stats in monitor.c, including its trailing
+// padding.
+type flowStats struct {
+	Packets    uint64
+	Bytes      uint64
+	FirstSeen  uint64
+	LastSeen   uint64
+	TunnelSrc  [16]byte
+	TunnelDst  [16]byte
+	TCPFlags   uint8
+	TunnelType uint8
+	_          [2]uint8
+	SampleRate uint32
+}
+
+// Flow is one direction of a 5-tuple as seen on one hook, read from the
+// flow map. Packets and bytes are cumulative since the flow was created, and
+// scaled up from the sampled packets when sampling is enabled.
+type Flow struct {
+	ConnInfo
+	Packets   uint64
+	Bytes     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// TCPFlags is every TCP flag seen on the flow.
+	TCPFlags uint8
+	// Tunnel is set when the flow was decapsulated from an overlay.
+	Tunnel Tunnel
+	// SampleRate is the sampling rate the flow was last recorded at, 1 in
+	// SampleRate packets; 1 without sampling. It is informational: Packets
+	// and Bytes are already scaled.
+	SampleRate uint32
+}
+
+// flowKey mirrors struct flow_key in monitor.c, including its trailing
+// padding, so that batches of keys can be copied straight from the kernel.
+type flowKey struct {
+	SrcIP     [16]byte
+	DstIP     [16]byte
+	SrcPort   [2]byte
+	DstPort   [2]byte
+	Protocol  uint8
+	Direction uint8
+	_         [2]uint8
+}
+
+func (k *flowKey) connInfo() ConnInfo {
+	return ConnInfo{
+		SrcIP:     addrFrom16(k.SrcIP[:]),
+		DstIP:     addrFrom16(k.DstIP[:]),
+		SrcPort:   binary.BigEndian.Uint16(k.SrcPort[:]),
+		DstPort:   binary.BigEndian.Uint16(k.DstPort[:]),
+		Protocol:  k.Protocol,
+		Direction: k.Direction,
+	}
+}
+
+// GetFlows returns every flow in the flow map.
+func (c *Collector) GetFlows() ([]Flow, error) {
+	flows, _, err := c.readFlows(false)
+	return flows, err
+}
+
+// readFlows reads the whole flow map in one pass, returning the flows along
+// with their raw keys. With del set, the flows are removed as they are read.
+func (c *Collector) readFlows(del bool) ([]Flow, []flowKey, error) {
+	clock, err := newKtimeClock()
+	if err != nil {
+		return nil, nil, err
+	}
+	dump, err := dumpMap[flowKey, flowStats](c.flowMap, c.features.BatchOps, del)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read flow_map: %v", err)
+	}
+	c.recordEntries(mapIDFlow, len(dump.Keys))
+
+	flows := make([]Flow, len(dump.Keys))
+	for i := range dump.Keys {
+		flows[i] = newFlow(dump.Keys[i].connInfo(), mergeFlowStats(dump.PerCPU(i)), clock)
+	}
+	return flows, dump.Keys, nil
+}
+
+func newFlow(key ConnInfo, value flowStats, clock ktimeClock) Flow {
+	return Flow{
+		ConnInfo:   key,
+		Packets:    value.Packets,
+		Bytes:      value.Bytes,
+		FirstSeen:  clock.Time(value.FirstSeen),
+		LastSeen:   clock.Time(value.LastSeen),
+		TCPFlags:   value.TCPFlags,
+		Tunnel:     newTunnel(value),
+		SampleRate: max(value.SampleRate, 1),
+	}
+}
+
+// ProtocolName returns the protocol as reported in ConnectionStats.
+func (c ConnInfo) ProtocolName() string {
+	return protocolToString(c.Protocol)
+}
+
+// DirectionName returns the direction as reported in ConnectionStats.
+func (c ConnInfo) DirectionName() string {
+	return directionToString(c.Direction)
+}
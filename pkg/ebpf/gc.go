@@ -0,0 +1,109 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// maxEndedFlows bounds the ended flow records kept between two reads.
+const maxEndedFlows = 65536
+
+// runFlowGC expires idle flows until done is closed. It runs several times per
+// timeout so that flows are removed soon after they become idle.
+func (c *Collector) runFlowGC(done <-chan struct{}) {
+	interval := c.config.FlowIdleTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			expired, err := c.expireFlows(c.config.FlowIdleTimeout)
+			if err != nil {
+				log.Printf("Flow GC failed: %v", err)
+			} else if expired > 0 {
+				log.Printf("Flow GC expired %d idle flow(s)", expired)
+			}
+		}
+	}
+}
+
+// expireFlows deletes the flows that saw no packet for longer than timeout
+// and records a final "flow ended" entry for each, to be read through
+// EndedFlows. A packet arriving between the read and the delete is lost
+// with the entry.
+func (c *Collector) expireFlows(timeout time.Duration) (int, error) {
+	flows, keys, err := c.readFlows(false)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-timeout)
+	var idle []flowKey
+	var ended []Flow
+	for i, flow := range flows {
+		if flow.LastSeen.After(cutoff) {
+			continue
+		}
+		idle = append(idle, keys[i])
+		ended = append(ended, flow)
+	}
+	if len(idle) == 0 {
+		return 0, nil
+	}
+
+	if err := c.deleteFlows(idle); err != nil {
+		return 0, err
+	}
+
+	c.publishFlowEnds(ended)
+
+	c.endedMu.Lock()
+	defer c.endedMu.Unlock()
+	c.endedFlows = append(c.endedFlows, ended...)
+	if overflow := len(c.endedFlows) - maxEndedFlows; overflow > 0 {
+		log.Printf("Discarding %d unread ended flow records", overflow)
+		c.endedFlows = c.endedFlows[overflow:]
+	}
+	return len(ended), nil
+}
+
+// EndedFlows returns the flows expired since the previous call, with their
+// final counters.
+func (c *Collector) EndedFlows() []Flow {
+	c.endedMu.Lock()
+	defer c.endedMu.Unlock()
+	ended := c.endedFlows
+	c.endedFlows = nil
+	return ended
+}
+
+// deleteFlows removes keys from the flow map, in a single batch when the
+// kernel supports it. Keys the LRU already evicted are skipped.
+func (c *Collector) deleteFlows(keys []flowKey) error {
+	if c.features.BatchOps {
+		_, err := c.flowMap.BatchDelete(keys, nil)
+		if err == nil {
+			return nil
+		}
+		// A batch stops at the first missing key, so retry one at a time
+		if !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Batch delete of flows failed, deleting one at a time: %v", err)
+		}
+	}
+	for i := range keys {
+		if err := c.flowMap.Delete(&keys[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to expire flow: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package ebpf
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/cilium/ebpf"
+)
+
+// histBuckets matches HIST_BUCKETS in monitor.c.
+const histBuckets = 24
+
+// histKey mirrors struct hist_key in monitor.c, including its trailing
+// padding.
+type histKey struct {
+	SrcIP [16]byte
+	DstIP [16]byte
+	Kind  uint8
+	_     [3]uint8
+}
+
+// histValue mirrors struct hist in monitor.c.
+type histValue struct {
+	Buckets [histBuckets]uint64
+	Sum     uint64
+}
+
+// Histogram is a log2 histogram maintained in the kernel for one address
+// pair. Buckets[i] counts the integer values from 2^i to 2^(i+1)-1, except
+// that the first bucket also holds 0 and the last every larger value.
+// Counts and Sum are cumulative since the entry was created.
+type Histogram struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	// Kind is the protocol for packet sizes and the RTT kind ("handshake" or
+	// "data") for RTTs.
+	Kind    string
+	Buckets []uint64
+	Count   uint64
+	Sum     uint64
+}
+
+// UpperBound returns the largest value counted in bucket i, the inclusive
+// bound that Prometheus buckets expect. The last bucket has none; its values
+// are only included in Count.
+func (h Histogram) UpperBound(i int) uint64 {
+	return 1<<(i+1) - 1
+}
+
+// GetPacketSizeHistograms returns the distribution of packet sizes in bytes,
+// per address pair and protocol.
+func (c *Collector) GetPacketSizeHistograms() ([]Histogram, error) {
+	return c.readHistograms(c.sizeHistMap, mapIDSizeHist, "size_hist", protocolToString)
+}
+
+// GetRTTHistograms returns the distribution of RTT samples in microseconds,
+// keyed like GetRTTs.
+func (c *Collector) GetRTTHistograms() ([]Histogram, error) {
+	return c.readHistograms(c.rttHistMap, mapIDRTTHist, "rtt_hist", rttKindToString)
+}
+
+func (c *Collector) readHistograms(m *ebpf.Map, id uint32, name string, kindName func(uint8) string) ([]Histogram, error) {
+	dump, err := dumpMap[histKey, histValue](m, c.features.BatchOps, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	c.recordEntries(id, len(dump.Keys))
+
+	hists := make([]Histogram, len(dump.Keys))
+	for i, key := range dump.Keys {
+		h := Histogram{
+			Source:      addrFrom16(key.SrcIP[:]),
+			Destination: addrFrom16(key.DstIP[:]),
+			Kind:        kindName(key.Kind),
+			Buckets:     make([]uint64, histBuckets),
+		}
+		for _, value := range dump.PerCPU(i) {
+			for b, n := range value.Buckets {
+				h.Buckets[b] += n
+				h.Count += n
+			}
+			h.Sum += value.Sum
+		}
+		hists[i] = h
+	}
+	return hists, nil
+}
@@ -0,0 +1,22 @@
+package ebpf
+
+import "testing"
+
+func TestHistogramUpperBound(t *testing.T) {
+	// Bucket i holds floor(log2(v)) == i, as log2_bucket in monitor.c
+	tests := []struct {
+		bucket int
+		want   uint64
+	}{
+		{0, 1},
+		{1, 3},
+		{2, 7},
+		{10, 2047},
+	}
+	var h Histogram
+	for _, tt := range tests {
+		if got := h.UpperBound(tt.bucket); got != tt.want {
+			t.Errorf("UpperBound(%d) = %d, want %d", tt.bucket, got, tt.want)
+		}
+	}
+}
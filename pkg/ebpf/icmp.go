@@ -0,0 +1,122 @@
+package ebpf
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+const protocolICMPv6 uint8 = 58
+
+// icmpKey mirrors struct icmp_key in monitor.c, including its trailing
+// padding.
+type icmpKey struct {
+	SrcIP    [16]byte
+	DstIP    [16]byte
+	Protocol uint8
+	Type     uint8
+	Code     uint8
+	_        uint8
+}
+
+// ICMPStats counts the ICMP or ICMPv6 messages of one type and code sent
+// from Source to Destination.
+type ICMPStats struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	// Protocol is "ICMP" or "ICMPv6".
+	Protocol string
+	Type     uint8
+	Code     uint8
+	// Message classifies the type and code, such as "echo_request". The
+	// errors that point at path problems have their own names whatever the
+	// protocol: "frag_needed" (including ICMPv6 packet too big),
+	// "ttl_exceeded" and "dest_unreachable".
+	Message string
+	// Count is cumulative since the entry was created.
+	Count uint64
+}
+
+// GetICMP returns the ICMP and ICMPv6 messages counted per address pair,
+// type and code.
+func (c *Collector) GetICMP() ([]ICMPStats, error) {
+	dump, err := dumpMap[icmpKey, uint64](c.icmpMap, c.features.BatchOps, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read icmp_map: %v", err)
+	}
+	c.recordEntries(mapIDICMP, len(dump.Keys))
+
+	stats := make([]ICMPStats, len(dump.Keys))
+	for i, key := range dump.Keys {
+		stats[i] = ICMPStats{
+			Source:      addrFrom16(key.SrcIP[:]),
+			Destination: addrFrom16(key.DstIP[:]),
+			Protocol:    protocolToString(key.Protocol),
+			Type:        key.Type,
+			Code:        key.Code,
+			Message:     icmpMessage(key.Protocol, key.Type, key.Code),
+			Count:       sumPerCPU(dump.PerCPU(i)),
+		}
+	}
+	return stats, nil
+}
+
+// icmpMessage names an ICMP (RFC 792) or ICMPv6 (RFC 4443, RFC 4861) type
+// and code.
+func icmpMessage(protocol, typ, code uint8) string {
+	if protocol == protocolICMPv6 {
+		switch typ {
+		case 1:
+			return "dest_unreachable"
+		case 2:
+			return "frag_needed"
+		case 3:
+			if code == 0 {
+				return "ttl_exceeded"
+			}
+			return "time_exceeded"
+		case 4:
+			return "parameter_problem"
+		case 128:
+			return "echo_request"
+		case 129:
+			return "echo_reply"
+		case 133:
+			return "router_solicitation"
+		case 134:
+			return "router_advertisement"
+		case 135:
+			return "neighbor_solicitation"
+		case 136:
+			return "neighbor_advertisement"
+		case 137:
+			return "redirect"
+		}
+		return "other"
+	}
+
+	switch typ {
+	case 0:
+		return "echo_reply"
+	case 3:
+		if code == 4 {
+			return "frag_needed"
+		}
+		return "dest_unreachable"
+	case 5:
+		return "redirect"
+	case 8:
+		return "echo_request"
+	case 11:
+		if code == 0 {
+			return "ttl_exceeded"
+		}
+		return "time_exceeded"
+	case 12:
+		return "parameter_problem"
+	case 13:
+		return "timestamp_request"
+	case 14:
+		return "timestamp_reply"
+	}
+	return "other"
+}
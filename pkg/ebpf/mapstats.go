@@ -0,0 +1,114 @@
+package ebpf
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// Indexes into the map_errors map, matching MAP_ID_* in monitor.c
+const (
+	mapIDFlow uint32 = iota
+	mapIDTCPConn
+	mapIDLatency
+	mapIDDrop
+	mapIDEvents
+	mapIDRetransmit
+	mapIDICMP
+	mapIDSizeHist
+	mapIDRTTHist
+)
+
+// MapUsage reports how full a map is and how many inserts into it failed.
+type MapUsage struct {
+	Name string
+	// Entries is the number of entries at the last read of the map.
+	Entries    uint32
+	MaxEntries uint32
+	// InsertFailures is cumulative since the program was loaded.
+	InsertFailures uint64
+}
+
+type trackedMap struct {
+	id   uint32
+	name string
+	m    *ebpf.Map
+}
+
+// trackedMaps returns the maps whose usage is reported. Names are those of
+// monitor.c, since the kernel truncates map names to 15 characters.
+func (c *Collector) trackedMaps() []trackedMap {
+	return []trackedMap{
+		{mapIDFlow, "flow_map", c.flowMap},
+		{mapIDTCPConn, "tcp_conn_map", c.tcpConnMap},
+		{mapIDLatency, "latency_map", c.latencyMap},
+		{mapIDDrop, "drop_map", c.dropMap},
+		{mapIDRetransmit, "retransmit_map", c.retransmitMap},
+		{mapIDICMP, "icmp_map", c.icmpMap},
+		{mapIDSizeHist, "size_hist", c.sizeHistMap},
+		{mapIDRTTHist, "rtt_hist", c.rttHistMap},
+	}
+}
+
+// GetMapUsage returns the occupancy and failed inserts of every per-flow map.
+func (c *Collector) GetMapUsage() ([]MapUsage, error) {
+	var usage []MapUsage
+	for _, t := range c.trackedMaps() {
+		entries, err := c.entries(t.id, t.m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count entries of %s: %v", t.name, err)
+		}
+		var failures []uint64
+		if err := c.mapErrorsMap.Lookup(t.id, &failures); err != nil {
+			return nil, fmt.Errorf("failed to read insert failures of %s: %v", t.name, err)
+		}
+		usage = append(usage, MapUsage{
+			Name:           t.name,
+			Entries:        entries,
+			MaxEntries:     t.m.MaxEntries(),
+			InsertFailures: sumPerCPU(failures),
+		})
+	}
+	return usage, nil
+}
+
+// recordEntries notes the number of entries a dump of the tracked map id read.
+func (c *Collector) recordEntries(id uint32, n int) {
+	c.entriesMu.Lock()
+	defer c.entriesMu.Unlock()
+	if c.mapEntries == nil {
+		c.mapEntries = make(map[uint32]uint32)
+	}
+	c.mapEntries[id] = uint32(n)
+}
+
+// entries returns the number of entries of the tracked map id at its last
+// dump, and only walks m when it has not been dumped yet.
+func (c *Collector) entries(id uint32, m *ebpf.Map) (uint32, error) {
+	c.entriesMu.Lock()
+	n, ok := c.mapEntries[id]
+	c.entriesMu.Unlock()
+	if ok {
+		return n, nil
+	}
+	return countEntries(m)
+}
+
+// countEntries walks the keys of a hash map. Entries may come and go during
+// the walk, so the count is bounded by the map's capacity.
+func countEntries(m *ebpf.Map) (uint32, error) {
+	var count uint32
+	var key []byte
+	for count < m.MaxEntries() {
+		next, err := m.NextKeyBytes(key)
+		if err != nil {
+			return count, err
+		}
+		if next == nil {
+			break
+		}
+		key = next
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,50 @@
+package ebpf
+
+import "github.com/cilium/ebpf"
+
+// hasPerCPUValue reports whether maps of type t hold a value per CPU.
+func hasPerCPUValue(t ebpf.MapType) bool {
+	return t == ebpf.PerCPUHash || t == ebpf.PerCPUArray || t == ebpf.LRUCPUHash
+}
+
+// sumPerCPU adds up the per-CPU copies of a counter.
+func sumPerCPU(values []uint64) uint64 {
+	var sum uint64
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+// mergeFlowStats combines the per-CPU copies of a flow. CPUs that never saw
+// the flow hold zeroes and are skipped for the timestamps. The tunnel
+// endpoints are those of the CPU that saw an encapsulated packet last.
+//
+// The kernel scales Packets and Bytes as it samples, so the copies are
+// summed as they are. SampleRate is that of the CPU that saw the flow last.
+func mergeFlowStats(values []flowStats) flowStats {
+	var merged flowStats
+	var tunnelSeen uint64
+	for _, v := range values {
+		if v.Packets == 0 {
+			continue
+		}
+		if v.TunnelType != 0 && v.LastSeen >= tunnelSeen {
+			merged.TunnelType = v.TunnelType
+			merged.TunnelSrc = v.TunnelSrc
+			merged.TunnelDst = v.TunnelDst
+			tunnelSeen = v.LastSeen
+		}
+		merged.Packets += v.Packets
+		merged.Bytes += v.Bytes
+		if merged.FirstSeen == 0 || v.FirstSeen < merged.FirstSeen {
+			merged.FirstSeen = v.FirstSeen
+		}
+		if v.LastSeen > merged.LastSeen {
+			merged.LastSeen = v.LastSeen
+			merged.SampleRate = v.SampleRate
+		}
+		merged.TCPFlags |= v.TCPFlags
+	}
+	return merged
+}
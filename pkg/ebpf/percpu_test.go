@@ -0,0 +1,177 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+// benchFlows is the number of flows in the maps read by BenchmarkReadFlows.
+const benchFlows = 4096
+
+// newBenchFlowMap creates a flow map of type t holding benchFlows flows, or
+// skips b when maps cannot be created, such as without CAP_BPF.
+func newBenchFlowMap(b *testing.B, t ebpf.MapType) *ebpf.Map {
+	b.Helper()
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       t,
+		KeySize:    uint32(binary.Size(flowKey{})),
+		ValueSize:  uint32(binary.Size(flowStats{})),
+		MaxEntries: benchFlows,
+	})
+	if err != nil {
+		b.Skipf("cannot create %s map: %v", t, err)
+	}
+	b.Cleanup(func() { m.Close() })
+
+	cpus := 1
+	if hasPerCPUValue(t) {
+		if cpus, err = ebpf.PossibleCPU(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	values := make([]flowStats, cpus)
+	for i := range values {
+		values[i] = flowStats{Packets: 1, Bytes: 100, FirstSeen: 1, LastSeen: 2, SampleRate: 1}
+	}
+	for i := 0; i < benchFlows; i++ {
+		var key flowKey
+		binary.BigEndian.PutUint32(key.SrcIP[12:], uint32(i))
+		var value any = &values[0]
+		if hasPerCPUValue(t) {
+			value = values
+		}
+		if err := m.Put(&key, value); err != nil {
+			b.Fatalf("failed to fill map: %v", err)
+		}
+	}
+	return m
+}
+
+func TestMergeFlowStats(t *testing.T) {
+	tunnel := [16]byte{10: 0xff, 11: 0xff, 12: 10, 15: 1}
+	values := []flowStats{
+		// Sampled at 1 in 4: the kernel already counted 4 packets per sample
+		{Packets: 8, Bytes: 800, FirstSeen: 20, LastSeen: 30, TCPFlags: 0x02, SampleRate: 4},
+		{},
+		{Packets: 1, Bytes: 60, FirstSeen: 10, LastSeen: 40, TCPFlags: 0x10, TunnelType: 1, TunnelSrc: tunnel, SampleRate: 1},
+	}
+	got := mergeFlowStats(values)
+	want := flowStats{
+		Packets:    9,
+		Bytes:      860,
+		FirstSeen:  10,
+		LastSeen:   40,
+		TCPFlags:   0x12,
+		TunnelType: 1,
+		TunnelSrc:  tunnel,
+		SampleRate: 1,
+	}
+	if got != want {
+		t.Errorf("mergeFlowStats = %+v, want %+v", got, want)
+	}
+}
+
+// BenchmarkReadFlows compares reading and merging the per-CPU flow map
+// with reading the shared map it replaced.
+func BenchmarkReadFlows(b *testing.B) {
+	for _, t := range []ebpf.MapType{ebpf.LRUCPUHash, ebpf.LRUHash} {
+		b.Run(t.String(), func(b *testing.B) {
+			m := newBenchFlowMap(b, t)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dump, err := dumpMap[flowKey, flowStats](m, true, false)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for j := range dump.Keys {
+					mergeFlowStats(dump.PerCPU(j))
+				}
+			}
+		})
+	}
+}
+
+// counterProgram returns an XDP program that adds one to the counter at key
+// 0 of m, with an atomic add unless m holds a copy per CPU.
+func counterProgram(b *testing.B, m *ebpf.Map) *ebpf.Program {
+	b.Helper()
+	add := asm.Instructions{asm.StoreXAdd(asm.R0, asm.R1, asm.DWord)}
+	if hasPerCPUValue(m.Type()) {
+		add = asm.Instructions{
+			asm.LoadMem(asm.R2, asm.R0, 0, asm.DWord),
+			asm.Add.Reg(asm.R2, asm.R1),
+			asm.StoreMem(asm.R0, 0, asm.R2, asm.DWord),
+		}
+	}
+
+	insns := asm.Instructions{
+		asm.StoreImm(asm.RFP, -4, 0, asm.Word),
+		asm.LoadMapPtr(asm.R1, m.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -4),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "exit"),
+		asm.Mov.Imm(asm.R1, 1),
+	}
+	insns = append(insns, add...)
+	insns = append(insns,
+		asm.Mov.Imm(asm.R0, 2).WithSymbol("exit"), // XDP_PASS
+		asm.Return(),
+	)
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.XDP,
+		Instructions: insns,
+		License:      "GPL",
+	})
+	if err != nil {
+		b.Skipf("cannot load program: %v", err)
+	}
+	b.Cleanup(func() { prog.Close() })
+	return prog
+}
+
+// BenchmarkCounterUpdate runs a counter update through BPF_PROG_TEST_RUN on
+// every CPU at once, against a per-CPU and a shared counter. It needs
+// privileges to load programs and is skipped without them.
+func BenchmarkCounterUpdate(b *testing.B) {
+	const repeat = 1000
+	packet := make([]byte, 64)
+
+	for _, t := range []ebpf.MapType{ebpf.PerCPUArray, ebpf.Array} {
+		b.Run(t.String(), func(b *testing.B) {
+			m, err := ebpf.NewMap(&ebpf.MapSpec{Type: t, KeySize: 4, ValueSize: 8, MaxEntries: 1})
+			if err != nil {
+				b.Skipf("cannot create %s map: %v", t, err)
+			}
+			b.Cleanup(func() { m.Close() })
+			prog := counterProgram(b, m)
+			if _, _, err := prog.Benchmark(packet, 1, nil); err != nil {
+				b.Skipf("cannot test run program: %v", err)
+			}
+
+			// Benchmark reports the mean time of one run, the cost of a
+			// packet while every CPU updates the same counter.
+			var runs, nanos atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, d, err := prog.Benchmark(packet, repeat, nil)
+					if err != nil {
+						b.Errorf("failed to test run program: %v", err)
+						return
+					}
+					runs.Add(1)
+					nanos.Add(d.Nanoseconds())
+				}
+			})
+			if n := runs.Load(); n > 0 {
+				b.ReportMetric(float64(nanos.Load())/float64(n), "ns/pkt")
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package ebpf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/link"
+)
+
+// Pins live under Config.PinPath: maps/<layout>/ holds the maps by name,
+// where <layout> is the fingerprint of their layout, and links/ the XDP and
+// tcx links as <interface>.<hook>, such as eth0.xdp-driver, along with the
+// tracepoint links as tracing:<program>.tp_btf.
+const (
+	mapPinDir  = "maps"
+	linkPinDir = "links"
+)
+
+// mapSchemaVersion is part of the map layout fingerprint. Bump it when the
+// meaning of map contents changes without their types changing, such as
+// renumbering MAP_ID_* or TCP_EVENT_* in monitor.c.
+const mapSchemaVersion = 1
+
+// unpinnedMaps are recreated on every start: the ring buffer, since its
+// reader belongs to one run, and the maps written from the config.
+var unpinnedMaps = map[string]bool{
+	"events":            true,
+	"cidr_filter":       true,
+	"port_filter":       true,
+	"filter_config":     true,
+	"sample_rates":      true,
+	"skip_decapsulated": true,
+}
+
+// pinMaps marks the state maps of spec to be pinned by name, so that a
+// restarted collector picks up their contents. The data sections holding the
+// load-time constants are never pinned.
+func pinMaps(spec *ebpf.CollectionSpec) {
+	for name, m := range spec.Maps {
+		if strings.HasPrefix(name, ".") || unpinnedMaps[name] {
+			continue
+		}
+		m.Pinning = ebpf.PinByName
+	}
+}
+
+// mapLayout returns the fingerprint of the layout of the maps pinned from
+// spec: their types and the BTF of their keys and values. Maps are pinned
+// under a directory named after it, so that a change of layout, which
+// MapSpec.Compatible does not detect when the sizes stay the same, starts
+// from fresh maps.
+func mapLayout(spec *ebpf.CollectionSpec) string {
+	var names []string
+	for name, m := range spec.Maps {
+		if m.Pinning == ebpf.PinByName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "schema %d\n", mapSchemaVersion)
+	for _, name := range names {
+		m := spec.Maps[name]
+		fmt.Fprintf(h, "%s %s ", name, m.Type)
+		writeTypeLayout(h, m.Key)
+		io.WriteString(h, " ")
+		writeTypeLayout(h, m.Value)
+		io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// writeTypeLayout writes the names, offsets and types of every field of t,
+// ignoring typedefs and qualifiers.
+func writeTypeLayout(w io.Writer, t btf.Type) {
+	switch t := btf.UnderlyingType(t).(type) {
+	case nil:
+		io.WriteString(w, "?")
+	case *btf.Struct:
+		writeMembersLayout(w, "struct", t.Size, t.Members)
+	case *btf.Union:
+		writeMembersLayout(w, "union", t.Size, t.Members)
+	case *btf.Array:
+		fmt.Fprintf(w, "[%d]", t.Nelems)
+		writeTypeLayout(w, t.Type)
+	case *btf.Int:
+		fmt.Fprintf(w, "int%d/%s", t.Size, t.Encoding)
+	default:
+		size, _ := btf.Sizeof(t)
+		fmt.Fprintf(w, "%T/%d", t, size)
+	}
+}
+
+func writeMembersLayout(w io.Writer, kind string, size uint32, members []btf.Member) {
+	fmt.Fprintf(w, "%s%d{", kind, size)
+	for _, m := range members {
+		fmt.Fprintf(w, "%s@%d:%d ", m.Name, m.Offset, m.BitfieldSize)
+		writeTypeLayout(w, m.Type)
+		io.WriteString(w, ";")
+	}
+	io.WriteString(w, "}")
+}
+
+// removeOtherLayouts removes the maps pinned under a layout other than
+// layout, once the maps of the current one are in place.
+func removeOtherLayouts(pinPath, layout string) {
+	dir := filepath.Join(pinPath, mapPinDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to list pinned maps: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() == layout {
+			continue
+		}
+		log.Printf("Removing maps pinned with layout %s", entry.Name())
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("Failed to remove pinned maps: %v", err)
+		}
+	}
+}
+
+// loadObjects loads the collection into objs, reusing the maps pinned by a
+// previous run with the same map layout. Pinned maps whose sizes no longer
+// match, after a change of MapSizes, are removed and created anew, losing
+// their contents.
+func loadObjects(spec *ebpf.CollectionSpec, objs any, opts *ebpf.CollectionOptions) error {
+	err := spec.LoadAndAssign(objs, opts)
+	if !errors.Is(err, ebpf.ErrMapIncompatible) {
+		return err
+	}
+	removed, rerr := removeIncompatiblePins(spec, opts.Maps.PinPath)
+	if rerr != nil {
+		return errors.Join(err, rerr)
+	}
+	if removed == 0 {
+		return err
+	}
+	return spec.LoadAndAssign(objs, opts)
+}
+
+func removeIncompatiblePins(spec *ebpf.CollectionSpec, dir string) (int, error) {
+	var removed int
+	for name, ms := range spec.Maps {
+		if ms.Pinning != ebpf.PinByName {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		m, err := ebpf.LoadPinnedMap(path, nil)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return removed, fmt.Errorf("failed to load pinned map %s: %v", name, err)
+		}
+		err = ms.Compatible(m)
+		m.Close()
+		if err == nil {
+			continue
+		}
+		log.Printf("Recreating pinned map %s: %v", name, err)
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// pinnedLink is a link pinned on bpffs. Closing it detaches the program;
+// releasing it only closes the file descriptor, leaving the program attached
+// for the next run to take over.
+type pinnedLink struct {
+	link.Link
+}
+
+func (l pinnedLink) Close() error {
+	return errors.Join(l.Unpin(), l.Link.Close())
+}
+
+func (l pinnedLink) Release() error {
+	return l.Link.Close()
+}
+
+// linkPin returns the pin path of the link attaching hook to an interface,
+// or "" when pinning is disabled.
+func (c *Collector) linkPin(ifname, hook string) string {
+	if c.config.PinPath == "" {
+		return ""
+	}
+	return filepath.Join(c.config.PinPath, linkPinDir, ifname+"."+hook)
+}
+
+// takeOverLink loads the link pinned at path by a previous run and swaps in
+// prog, so that the interface never goes unobserved across a restart. It
+// returns nil, removing the pin if it is unusable, when there is no link to
+// take over.
+func takeOverLink(path string, ifindex int, prog *ebpf.Program) link.Link {
+	if path == "" {
+		return nil
+	}
+	l, err := link.LoadPinnedLink(path, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Discarding pinned link %s: %v", path, err)
+		os.Remove(path)
+		return nil
+	}
+
+	// An interface deleted while the collector was down leaves a defunct
+	// link, and its name may since belong to another interface
+	if linkIfindex(l) != uint32(ifindex) {
+		err = errors.New("interface has changed")
+	} else {
+		err = l.Update(prog)
+	}
+	if err != nil {
+		log.Printf("Discarding pinned link %s: %v", path, err)
+		l.Unpin()
+		l.Close()
+		return nil
+	}
+	return l
+}
+
+func linkIfindex(l link.Link) uint32 {
+	info, err := l.Info()
+	if err != nil {
+		return 0
+	}
+	if xdp := info.XDP(); xdp != nil {
+		return xdp.Ifindex
+	}
+	if tcx := info.TCX(); tcx != nil {
+		return tcx.Ifindex
+	}
+	return 0
+}
+
+// pinLink pins a newly attached link at path, unless pinning is disabled.
+// A link that cannot be pinned stays attached for this run only.
+func pinLink(l link.Link, path string) io.Closer {
+	if path == "" {
+		return l
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err == nil {
+		err = l.Pin(path)
+	}
+	if err != nil {
+		log.Printf("Failed to pin link %s, it will not survive a restart: %v", path, err)
+		return l
+	}
+	return pinnedLink{l}
+}
+
+// sweepLinkPins detaches the links pinned by a previous run that this run
+// did not take over, such as those of interfaces that no longer match the
+// config or that were attached in another mode.
+func (c *Collector) sweepLinkPins() {
+	if c.config.PinPath == "" {
+		return
+	}
+	dir := filepath.Join(c.config.PinPath, linkPinDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to list pinned links: %v", err)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	inUse := make(map[string]bool)
+	for _, a := range c.attachments {
+		for _, pin := range a.pins {
+			inUse[pin] = true
+		}
+	}
+	if c.tracing != nil {
+		for _, pin := range c.tracing.pins {
+			inUse[pin] = true
+		}
+	}
+	c.mu.Unlock()
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if inUse[path] {
+			continue
+		}
+		if err := unpinLink(path); err != nil {
+			log.Printf("Failed to remove pinned link %s: %v", path, err)
+			continue
+		}
+		log.Printf("Detached stale pinned link %s", entry.Name())
+	}
+}
+
+func unpinLink(path string) error {
+	l, err := link.LoadPinnedLink(path, nil)
+	if err != nil {
+		return errors.Join(err, os.Remove(path))
+	}
+	return pinnedLink{l}.Close()
+}
+
+// RemovePins detaches every link pinned under pinPath and removes the pinned
+// maps, undoing what a collector configured with that PinPath leaves behind.
+// It is meant to run when the collector is uninstalled, not while one runs.
+func RemovePins(pinPath string) error {
+	var errs []error
+	dir := filepath.Join(pinPath, linkPinDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	for _, entry := range entries {
+		if err := unpinLink(filepath.Join(dir, entry.Name())); err != nil {
+			errs = append(errs, fmt.Errorf("failed to detach %s: %v", entry.Name(), err))
+		}
+	}
+	if err := os.RemoveAll(pinPath); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
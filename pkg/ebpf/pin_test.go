@@ -0,0 +1,49 @@
+package ebpf
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+func TestMapLayout(t *testing.T) {
+	u8 := &btf.Int{Name: "__u8", Size: 1}
+	u32 := &btf.Int{Name: "__u32", Size: 4}
+	spec := func(value *btf.Struct) *ebpf.CollectionSpec {
+		return &ebpf.CollectionSpec{Maps: map[string]*ebpf.MapSpec{
+			"tcp_conn_map": {Type: ebpf.LRUHash, Key: u32, Value: value, Pinning: ebpf.PinByName},
+			"events":       {Type: ebpf.RingBuf},
+		}}
+	}
+	padded := &btf.Struct{Name: "tcp_conn_state", Size: 4, Members: []btf.Member{
+		{Name: "state", Type: u8},
+	}}
+	// A field moved into what used to be padding keeps the size
+	reused := &btf.Struct{Name: "tcp_conn_state", Size: 4, Members: []btf.Member{
+		{Name: "state", Type: u8},
+		{Name: "flags", Type: u8, Offset: 8},
+	}}
+
+	base := mapLayout(spec(padded))
+	if got := mapLayout(spec(padded)); got != base {
+		t.Errorf("layout of the same spec changed from %s to %s", base, got)
+	}
+	if got := mapLayout(spec(reused)); got == base {
+		t.Errorf("layout %s did not change when padding was reused", got)
+	}
+
+	keyed := spec(padded)
+	keyed.Maps["tcp_conn_map"].Key = &btf.Struct{Name: "rtt_key", Size: 4, Members: []btf.Member{
+		{Name: "addr", Type: u32},
+	}}
+	if got := mapLayout(keyed); got == base {
+		t.Errorf("layout %s did not change with the key type", got)
+	}
+
+	unpinned := spec(padded)
+	unpinned.Maps["events"].MaxEntries = 1 << 20
+	if got := mapLayout(unpinned); got != base {
+		t.Errorf("layout changed from %s to %s with an unpinned map", base, got)
+	}
+}
@@ -0,0 +1,53 @@
+package ebpf
+
+import "fmt"
+
+// protocolNames names the IP protocol numbers seen in practice. Others are
+// reported by number.
+var protocolNames = map[uint8]string{
+	1:   "ICMP",
+	2:   "IGMP",
+	4:   "IPIP",
+	6:   "TCP",
+	17:  "UDP",
+	41:  "IPv6",
+	46:  "RSVP",
+	47:  "GRE",
+	50:  "ESP",
+	51:  "AH",
+	58:  "ICMPv6",
+	89:  "OSPF",
+	94:  "IPIP-BEET",
+	103: "PIM",
+	108: "IPComp",
+	112: "VRRP",
+	115: "L2TP",
+	132: "SCTP",
+	136: "UDPLite",
+	137: "MPLS-in-IP",
+	143: "Ethernet",
+}
+
+func protocolToString(protocol uint8) string {
+	if name, ok := protocolNames[protocol]; ok {
+		return name
+	}
+	return fmt.Sprintf("PROTO(%d)", protocol)
+}
+
+// GetProtocolCounts returns the packets seen per IP protocol, omitting
+// protocols that were never seen.
+func (c *Collector) GetProtocolCounts() (map[string]uint64, error) {
+	dump, err := dumpMap[uint32, uint64](c.protocolCountMap, c.features.BatchOps, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read protocol_count: %v", err)
+	}
+
+	counts := make(map[string]uint64)
+	for i, protocol := range dump.Keys {
+		if count := sumPerCPU(dump.PerCPU(i)); count > 0 {
+			counts[protocolToString(uint8(protocol))] = count
+		}
+	}
+	return counts, nil
+}
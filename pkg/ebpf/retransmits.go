@@ -0,0 +1,86 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/cilium/ebpf"
+)
+
+// Kinds of retransmission, matching RETRANS_* in monitor.c
+const (
+	retransKindData   uint8 = 0
+	retransKindSynAck uint8 = 1
+)
+
+// retransKey mirrors struct retrans_key in monitor.c, including its
+// trailing padding.
+type retransKey struct {
+	SrcIP   [16]byte
+	DstIP   [16]byte
+	SrcPort [2]byte
+	DstPort [2]byte
+	Kind    uint8
+	_       [3]uint8
+}
+
+// RetransmitStats counts the TCP retransmissions of one connection, from the
+// local socket to its peer.
+type RetransmitStats struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	SourcePort  uint16
+	DestPort    uint16
+	// Kind is "data" for retransmitted segments or "synack" for SYN-ACKs
+	// retransmitted to a client that did not complete the handshake.
+	Kind string
+	// Count is cumulative since the entry was created.
+	Count uint64
+}
+
+// GetRetransmits returns the retransmissions counted per connection.
+func (c *Collector) GetRetransmits() ([]RetransmitStats, error) {
+	dump, err := dumpMap[retransKey, uint64](c.retransmitMap, c.features.BatchOps, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retransmit_map: %v", err)
+	}
+	c.recordEntries(mapIDRetransmit, len(dump.Keys))
+
+	stats := make([]RetransmitStats, len(dump.Keys))
+	for i, key := range dump.Keys {
+		stats[i] = RetransmitStats{
+			Source:      addrFrom16(key.SrcIP[:]),
+			Destination: addrFrom16(key.DstIP[:]),
+			SourcePort:  binary.BigEndian.Uint16(key.SrcPort[:]),
+			DestPort:    binary.BigEndian.Uint16(key.DstPort[:]),
+			Kind:        retransKindToString(key.Kind),
+			Count:       sumPerCPU(dump.PerCPU(i)),
+		}
+	}
+	return stats, nil
+}
+
+func retransKindToString(kind uint8) string {
+	switch kind {
+	case retransKindData:
+		return "data"
+	case retransKindSynAck:
+		return "synack"
+	default:
+		return fmt.Sprintf("unknown(%d)", kind)
+	}
+}
+
+// loadRetransmitPrograms loads the TCP retransmission tracepoint programs on
+// their own, sharing the maps of the main collection.
+func loadRetransmitPrograms(spec *ebpf.CollectionSpec, maps map[string]*ebpf.Map) (skb, synack *ebpf.Program, err error) {
+	var objs struct {
+		RetransmitSkb    *ebpf.Program `ebpf:"on_tcp_retransmit_skb"`
+		RetransmitSynack *ebpf.Program `ebpf:"on_tcp_retransmit_synack"`
+	}
+	if err := spec.LoadAndAssign(&objs, &ebpf.CollectionOptions{MapReplacements: maps}); err != nil {
+		return nil, nil, err
+	}
+	return objs.RetransmitSkb, objs.RetransmitSynack, nil
+}
@@ -0,0 +1,119 @@
+package ebpf
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// RTT sample kinds, matching RTT_* in monitor.c
+const (
+	rttKindHandshake uint8 = 0
+	rttKindData      uint8 = 1
+)
+
+// rttKey mirrors struct rtt_key in monitor.c, including its trailing padding.
+// Addresses are 16-byte IPv6 addresses, IPv4-mapped for IPv4 traffic.
+type rttKey struct {
+	SrcIP [16]byte
+	DstIP [16]byte
+	Kind  uint8
+	_     [3]uint8
+}
+
+// rttData mirrors struct rtt_data in monitor.c.
+type rttData struct {
+	TotalNs uint64
+	Samples uint64
+}
+
+// RTTStats accumulates the round-trip times measured from Source to
+// Destination. Source is the initiator for handshake samples and the sender
+// of the timed segment for data samples.
+type RTTStats struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	// Kind is "handshake" (SYN to SYN-ACK) or "data" (segment to ACK).
+	Kind string
+	// Total and Samples are cumulative, so that the mean over an interval
+	// is the increase of Total divided by the increase of Samples.
+	Total   time.Duration
+	Samples uint64
+}
+
+// Mean returns the average RTT of the accumulated samples.
+func (s RTTStats) Mean() time.Duration {
+	if s.Samples == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Samples)
+}
+
+// GetRTTs returns the RTT samples accumulated per address pair and kind.
+func (c *Collector) GetRTTs() ([]RTTStats, error) {
+	dump, err := dumpMap[rttKey, rttData](c.latencyMap, c.features.BatchOps, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read latency_map: %v", err)
+	}
+	c.recordEntries(mapIDLatency, len(dump.Keys))
+
+	stats := make([]RTTStats, 0, len(dump.Keys))
+	for i, key := range dump.Keys {
+		stat := RTTStats{
+			Source:      addrFrom16(key.SrcIP[:]),
+			Destination: addrFrom16(key.DstIP[:]),
+			Kind:        rttKindToString(key.Kind),
+		}
+		for _, value := range dump.PerCPU(i) {
+			stat.Total += time.Duration(value.TotalNs)
+			stat.Samples += value.Samples
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// GetLatencies returns the average RTT in nanoseconds per address pair,
+// across sample kinds.
+func (c *Collector) GetLatencies() (map[netip.Addr]map[netip.Addr]uint64, error) {
+	rtts, err := c.GetRTTs()
+	if err != nil {
+		return nil, err
+	}
+	return averageRTTs(rtts), nil
+}
+
+func averageRTTs(rtts []RTTStats) map[netip.Addr]map[netip.Addr]uint64 {
+	type pair struct{ src, dst netip.Addr }
+	totals := make(map[pair]RTTStats)
+	for _, rtt := range rtts {
+		p := pair{rtt.Source, rtt.Destination}
+		t := totals[p]
+		t.Total += rtt.Total
+		t.Samples += rtt.Samples
+		totals[p] = t
+	}
+
+	latencies := make(map[netip.Addr]map[netip.Addr]uint64)
+	for p, t := range totals {
+		if t.Samples == 0 {
+			continue
+		}
+		if _, ok := latencies[p.src]; !ok {
+			latencies[p.src] = make(map[netip.Addr]uint64)
+		}
+		latencies[p.src][p.dst] = uint64(t.Mean())
+	}
+	return latencies
+}
+
+func rttKindToString(kind uint8) string {
+	switch kind {
+	case rttKindHandshake:
+		return "handshake"
+	case rttKindData:
+		return "data"
+	default:
+		return fmt.Sprintf("unknown(%d)", kind)
+	}
+}
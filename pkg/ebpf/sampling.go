@@ -0,0 +1,220 @@
+package ebpf
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// maxSampledIfindex matches MAX_SAMPLED_IFINDEX in monitor.c. Interfaces
+// with a larger ifindex are sampled at the default rate.
+const maxSampledIfindex = 65536
+
+// adaptiveInterval is how often adaptive sampling reconsiders the rate.
+const adaptiveInterval = 15 * time.Second
+
+// defaultMaxAdaptiveRate bounds adaptive sampling when MaxRate is unset.
+const defaultMaxAdaptiveRate = 1024
+
+// AdaptiveSampling raises the sampling rate while the agent exceeds a budget
+// and lowers it back once it is well within, doubling or halving the
+// configured rates each step.
+type AdaptiveSampling struct {
+	// CPUBudget is the share of one CPU the agent may use, counting both the
+	// eBPF programs and the collector process, such as 0.5. Zero disables
+	// the CPU check.
+	CPUBudget float64 `json:"cpu_budget,omitempty"`
+	// MapBudget is the share of flow_map capacity that may be in use, such
+	// as 0.8. Zero disables the check.
+	MapBudget float64 `json:"map_budget,omitempty"`
+	// MaxRate bounds the rates adaptive sampling may reach; 1024 by default.
+	MaxRate uint32 `json:"max_rate,omitempty"`
+}
+
+// sampling is the state behind the sample_rates map.
+type sampling struct {
+	base   uint32
+	ifaces map[int]uint32
+	// factor multiplies every configured rate, raised by adaptive sampling
+	factor uint32
+}
+
+func (a *AdaptiveSampling) maxRate() uint32 {
+	if a.MaxRate == 0 {
+		return defaultMaxAdaptiveRate
+	}
+	return a.MaxRate
+}
+
+// effectiveRate returns the rate written for a configured rate: scaled by
+// the adaptive factor, but never past the adaptive maximum unless the
+// configured rate already is.
+func (c *Collector) effectiveRate(rate uint32) uint32 {
+	rate = max(rate, 1)
+	if c.sampling.factor <= 1 {
+		return rate
+	}
+	scaled := uint64(rate) * uint64(c.sampling.factor)
+	return uint32(min(scaled, uint64(max(c.config.AdaptiveSampling.maxRate(), rate))))
+}
+
+// writeSampleRates writes the default rate and every per-interface rate.
+// The caller holds samplingMu.
+func (c *Collector) writeSampleRates() error {
+	if err := c.sampleRatesMap.Put(uint32(0), c.effectiveRate(c.sampling.base)); err != nil {
+		return fmt.Errorf("failed to set default sample rate: %v", err)
+	}
+	for ifindex, rate := range c.sampling.ifaces {
+		if err := c.sampleRatesMap.Put(uint32(ifindex), c.effectiveRate(rate)); err != nil {
+			return fmt.Errorf("failed to set sample rate of ifindex %d: %v", ifindex, err)
+		}
+	}
+	return nil
+}
+
+// SetSampleRate sets the default sampling rate: 1 in rate packets is recorded
+// in the flow map and packet size histograms on interfaces without a rate of
+// their own. 0 and 1 record every packet.
+func (c *Collector) SetSampleRate(rate uint32) error {
+	c.samplingMu.Lock()
+	defer c.samplingMu.Unlock()
+	c.sampling.base = rate
+	return c.writeSampleRates()
+}
+
+// SetInterfaceSampleRate sets the sampling rate of one interface. Zero
+// reverts it to the default rate.
+func (c *Collector) SetInterfaceSampleRate(ifindex int, rate uint32) error {
+	if ifindex <= 0 || ifindex >= maxSampledIfindex {
+		return fmt.Errorf("cannot set the sample rate of ifindex %d, outside 1-%d", ifindex, maxSampledIfindex-1)
+	}
+
+	c.samplingMu.Lock()
+	defer c.samplingMu.Unlock()
+	if rate == 0 {
+		delete(c.sampling.ifaces, ifindex)
+		if err := c.sampleRatesMap.Put(uint32(ifindex), uint32(0)); err != nil {
+			return fmt.Errorf("failed to clear sample rate of ifindex %d: %v", ifindex, err)
+		}
+		return nil
+	}
+	c.sampling.ifaces[ifindex] = rate
+	if err := c.sampleRatesMap.Put(uint32(ifindex), c.effectiveRate(rate)); err != nil {
+		return fmt.Errorf("failed to set sample rate of ifindex %d: %v", ifindex, err)
+	}
+	return nil
+}
+
+// SampleRate returns the sampling rate in effect on ifindex, including any
+// increase by adaptive sampling. Zero returns the default rate.
+func (c *Collector) SampleRate(ifindex int) uint32 {
+	c.samplingMu.Lock()
+	defer c.samplingMu.Unlock()
+	if rate, ok := c.sampling.ifaces[ifindex]; ok {
+		return c.effectiveRate(rate)
+	}
+	return c.effectiveRate(c.sampling.base)
+}
+
+// agentUsage samples the CPU time spent so far by the packet programs and by
+// this process.
+type agentUsage struct {
+	at  time.Time
+	cpu time.Duration
+}
+
+func (c *Collector) readAgentUsage() (agentUsage, error) {
+	usage := agentUsage{at: time.Now()}
+	for _, prog := range []*ebpf.Program{c.program, c.tcIngress, c.tcEgress} {
+		info, err := prog.Info()
+		if err != nil {
+			return usage, err
+		}
+		if runtime, ok := info.Runtime(); ok {
+			usage.cpu += runtime
+		}
+	}
+	var ru unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		return usage, err
+	}
+	usage.cpu += time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	return usage, nil
+}
+
+// runAdaptiveSampling adjusts the sampling factor until done is closed.
+func (c *Collector) runAdaptiveSampling(done <-chan struct{}) {
+	budget := c.config.AdaptiveSampling
+
+	// Program run time is only accounted while BPF statistics are enabled
+	stats, err := ebpf.EnableStats(uint32(unix.BPF_STATS_RUN_TIME))
+	if err != nil {
+		log.Printf("Failed to enable BPF run time statistics, adaptive sampling only counts the collector process: %v", err)
+	} else {
+		defer stats.Close()
+	}
+
+	previous, err := c.readAgentUsage()
+	if err != nil {
+		log.Printf("Adaptive sampling disabled: failed to read CPU usage: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := c.readAgentUsage()
+		if err != nil {
+			log.Printf("Adaptive sampling: failed to read CPU usage: %v", err)
+			continue
+		}
+		cpu := float64(current.cpu-previous.cpu) / float64(current.at.Sub(previous.at))
+		previous = current
+
+		entries, err := c.entries(mapIDFlow, c.flowMap)
+		if err != nil {
+			log.Printf("Adaptive sampling: failed to count flows: %v", err)
+			continue
+		}
+		pressure := float64(entries) / float64(c.flowMap.MaxEntries())
+
+		over := (budget.CPUBudget > 0 && cpu > budget.CPUBudget) ||
+			(budget.MapBudget > 0 && pressure > budget.MapBudget)
+		under := (budget.CPUBudget == 0 || cpu < budget.CPUBudget/2) &&
+			(budget.MapBudget == 0 || pressure < budget.MapBudget/2)
+		c.adjustSampling(over, under, cpu, pressure)
+	}
+}
+
+// adjustSampling doubles the sampling factor when over budget and halves it
+// when well under, logging each change.
+func (c *Collector) adjustSampling(over, under bool, cpu, pressure float64) {
+	c.samplingMu.Lock()
+	defer c.samplingMu.Unlock()
+
+	factor := c.sampling.factor
+	switch {
+	case over && factor*2 <= c.config.AdaptiveSampling.maxRate():
+		factor *= 2
+	case under && factor > 1:
+		factor /= 2
+	default:
+		return
+	}
+	c.sampling.factor = factor
+	if err := c.writeSampleRates(); err != nil {
+		log.Printf("Adaptive sampling: %v", err)
+		return
+	}
+	log.Printf("Adaptive sampling: CPU %.2f, flow map %.0f%% full, default rate now 1 in %d",
+		cpu, pressure*100, c.effectiveRate(c.sampling.base))
+}
@@ -0,0 +1,134 @@
+package ebpf
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// Snapshot is the per-flow state of the datapath, read in a single pass so
+// that packet and connection statistics derived from it agree.
+type Snapshot struct {
+	// Time is when the snapshot was taken.
+	Time  time.Time
+	Flows []Flow
+	RTTs  []RTTStats
+
+	// latencies is the average RTT per address pair, in nanoseconds.
+	latencies map[netip.Addr]map[netip.Addr]uint64
+	tcpStates map[tcpTuple]uint8
+}
+
+// Snapshot reads the flow, RTT and TCP state maps.
+func (c *Collector) Snapshot() (*Snapshot, error) {
+	return c.snapshot(false)
+}
+
+// SnapshotAndReset reads like Snapshot and also removes the flows it read,
+// so that each snapshot holds only the traffic seen since the previous one.
+func (c *Collector) SnapshotAndReset() (*Snapshot, error) {
+	return c.snapshot(true)
+}
+
+func (c *Collector) snapshot(reset bool) (*Snapshot, error) {
+	flows, _, err := c.readFlows(reset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get flows: %v", err)
+	}
+	rtts, err := c.GetRTTs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get RTTs: %v", err)
+	}
+	tcpStates, err := c.tcpStates()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TCP states: %v", err)
+	}
+	return &Snapshot{
+		Time:      time.Now(),
+		Flows:     flows,
+		RTTs:      rtts,
+		latencies: averageRTTs(rtts),
+		tcpStates: tcpStates,
+	}, nil
+}
+
+// PacketStats aggregates the flows of each source and destination pair
+// across ports, protocols and directions.
+func (s *Snapshot) PacketStats() []PacketStats {
+	type pair struct{ src, dst netip.Addr }
+	aggregated := make(map[pair]*PacketStats)
+	for _, flow := range s.Flows {
+		p := pair{flow.SrcIP, flow.DstIP}
+		stat, ok := aggregated[p]
+		if !ok {
+			stat = &PacketStats{
+				Source:      flow.SrcIP,
+				Destination: flow.DstIP,
+				Protocol:    protocolToString(flow.Protocol),
+				Latency:     s.latency(flow.SrcIP, flow.DstIP),
+				FirstSeen:   flow.FirstSeen,
+				LastSeen:    flow.LastSeen,
+			}
+			aggregated[p] = stat
+		}
+		if stat.Protocol != protocolToString(flow.Protocol) {
+			stat.Protocol = "mixed"
+		}
+		stat.Count += flow.Packets
+		stat.Bytes += flow.Bytes
+		if flow.FirstSeen.Before(stat.FirstSeen) {
+			stat.FirstSeen = flow.FirstSeen
+		}
+		if flow.LastSeen.After(stat.LastSeen) {
+			stat.LastSeen = flow.LastSeen
+		}
+	}
+
+	stats := make([]PacketStats, 0, len(aggregated))
+	for _, stat := range aggregated {
+		if stat.Count > 0 {
+			stat.Size = stat.Bytes / stat.Count
+		}
+		stats = append(stats, *stat)
+	}
+	return stats
+}
+
+// latency returns the average RTT between two addresses, measured in either
+// direction, since the handshake is keyed from whichever side initiated.
+func (s *Snapshot) latency(a, b netip.Addr) uint64 {
+	if l, ok := s.latencies[a][b]; ok {
+		return l
+	}
+	return s.latencies[b][a]
+}
+
+// ConnectionStats returns every flow of the snapshot with its TCP state,
+// attributed to Kubernetes resources.
+func (c *Collector) ConnectionStats(s *Snapshot) []ConnectionStats {
+	var stats []ConnectionStats
+	for connInfo, flow := range c.attributeFlows(s.Flows) {
+		stat := ConnectionStats{
+			Source:                connInfo.SourceIP,
+			Destination:           connInfo.DestIP,
+			SourcePort:            connInfo.SourcePort,
+			DestPort:              connInfo.DestPort,
+			Direction:             directionToString(connInfo.Direction),
+			Protocol:              protocolToString(connInfo.Protocol),
+			Count:                 flow.Packets,
+			Bytes:                 flow.Bytes,
+			FirstSeen:             flow.FirstSeen,
+			LastSeen:              flow.LastSeen,
+			TCPFlags:              flow.TCPFlags,
+			State:                 determineConnectionState(connInfo, s.tcpStates),
+			Service:               connInfo.Service,
+			ServiceNamespace:      connInfo.ServiceNamespace,
+			ServicePortName:       connInfo.ServicePortName,
+			BackendPod:            connInfo.BackendPod,
+			ServiceReadyEndpoints: connInfo.ServiceReadyEndpoints,
+			Tunnel:                flow.Tunnel,
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
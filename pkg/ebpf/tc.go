@@ -0,0 +1,159 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Attach modes recorded for tc attachments, depending on kernel support.
+const (
+	modeTCX    = "tcx"
+	modeClsact = "clsact"
+)
+
+// attachTC attaches the ingress and egress programs to a, preferring tcx
+// links and falling back to a clsact qdisc on kernels without tcx (< 6.6).
+func (c *Collector) attachTC(a *attachment) error {
+	if !c.features.SchedCLS {
+		return fmt.Errorf("kernel does not support sched_cls programs")
+	}
+
+	hooks := []struct {
+		name    string
+		program *ebpf.Program
+		attach  ebpf.AttachType
+		parent  uint32
+	}{
+		{"tcx-ingress", c.tcIngress, ebpf.AttachTCXIngress, netlink.HANDLE_MIN_INGRESS},
+		{"tcx-egress", c.tcEgress, ebpf.AttachTCXEgress, netlink.HANDLE_MIN_EGRESS},
+	}
+
+	for _, hook := range hooks {
+		pin := c.linkPin(a.name, hook.name)
+		if l := takeOverLink(pin, a.ifindex, hook.program); l != nil {
+			a.mode = modeTCX
+			a.hooks = append(a.hooks, pinnedLink{l})
+			a.pins = append(a.pins, pin)
+			continue
+		}
+
+		l, err := link.AttachTCX(link.TCXOptions{
+			Interface: a.ifindex,
+			Program:   hook.program,
+			Attach:    hook.attach,
+		})
+		if err == nil {
+			a.mode = modeTCX
+			a.hooks = append(a.hooks, pinLink(l, pin))
+			a.pins = append(a.pins, pin)
+			continue
+		}
+		if !errors.Is(err, ebpf.ErrNotSupported) {
+			return err
+		}
+
+		if a.mode != modeClsact {
+			log.Printf("tcx not supported on this kernel, using clsact qdisc for %s", a.name)
+		}
+		filter, err := attachClsact(a.ifindex, hook.program, hook.parent)
+		if err != nil {
+			return err
+		}
+		a.mode = modeClsact
+		a.hooks = append(a.hooks, filter)
+	}
+	return nil
+}
+
+// Slot of our filter on a clsact qdisc. Filters run in ascending priority,
+// and CNIs such as Cilium take priority 1 handle 1, so a dedicated slot
+// keeps ours from replacing theirs.
+const (
+	clsactPriority   = 0x4b4e
+	clsactHandle     = 0x4b4e
+	clsactFilterName = "kubenetinsight"
+)
+
+// clsactFilter is a direct-action bpf filter on a clsact qdisc.
+type clsactFilter struct {
+	filter *netlink.BpfFilter
+}
+
+func (f *clsactFilter) Close() error {
+	return netlink.FilterDel(f.filter)
+}
+
+func attachClsact(ifindex int, program *ebpf.Program, parent uint32) (*clsactFilter, error) {
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: ifindex,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	// The CNI may already have added the qdisc along with its filters
+	if err := netlink.QdiscAdd(qdisc); err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, fmt.Errorf("failed to add clsact qdisc: %v", err)
+	}
+
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: ifindex,
+			Parent:    parent,
+			Handle:    clsactHandle,
+			Protocol:  unix.ETH_P_ALL,
+			Priority:  clsactPriority,
+		},
+		Fd:           program.FD(),
+		Name:         clsactFilterName,
+		DirectAction: true,
+	}
+
+	owned, err := clsactSlotOwned(ifindex, parent)
+	if err != nil {
+		return nil, err
+	}
+	// Only a filter left by a previous run is ever replaced
+	if owned {
+		err = netlink.FilterReplace(filter)
+	} else {
+		err = netlink.FilterAdd(filter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to add clsact filter: %v", err)
+	}
+	return &clsactFilter{filter: filter}, nil
+}
+
+// clsactSlotOwned reports whether our priority on parent already holds a
+// filter of ours. It fails when another program holds it.
+func clsactSlotOwned(ifindex int, parent uint32) (bool, error) {
+	link, err := netlink.LinkByIndex(ifindex)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up interface %d: %v", ifindex, err)
+	}
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return false, fmt.Errorf("failed to list clsact filters: %v", err)
+	}
+	owned := false
+	for _, f := range filters {
+		attrs := f.Attrs()
+		if attrs.Priority != clsactPriority {
+			continue
+		}
+		bpf, ok := f.(*netlink.BpfFilter)
+		if !ok || bpf.Name != clsactFilterName || attrs.Handle != clsactHandle {
+			return false, fmt.Errorf("clsact priority %d on %s is used by another filter", clsactPriority, link.Attrs().Name)
+		}
+		owned = true
+	}
+	return owned, nil
+}
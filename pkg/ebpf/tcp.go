@@ -0,0 +1,248 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// TCP connection states, matching the TCP_STATE_* values in monitor.c
+const (
+	tcpStateSynSent     uint8 = 1
+	tcpStateEstablished uint8 = 2
+	tcpStateFinWait     uint8 = 3
+	tcpStateClosed      uint8 = 4
+	tcpStateReset       uint8 = 5
+)
+
+// finWaitTimeout ends connections that saw a FIN from one side only. With
+// XDP, which sees ingress only, or when the peer's FIN takes another path,
+// the second FIN is never seen and the connection would stay in FIN_WAIT
+// until evicted.
+const finWaitTimeout = 2 * time.Minute
+
+// tcpTombstoneTimeout is how long closed and reset connections stay in the
+// map after they were reported. Their entries absorb the ACKs and
+// retransmissions that trail the close, which would otherwise be taken for
+// a connection that predates the agent.
+const tcpTombstoneTimeout = time.Minute
+
+// Indexes into the tcp_events map
+const (
+	tcpEventOpen  uint32 = 0
+	tcpEventClose uint32 = 1
+	tcpEventReset uint32 = 2
+)
+
+// tcpConnKey mirrors struct tcp_conn_key in monitor.c. The source is the
+// connection's initiator; ports are kept in network byte order so the key
+// can be passed back to the map unchanged.
+type tcpConnKey struct {
+	SrcIP   [16]byte
+	DstIP   [16]byte
+	SrcPort [2]byte
+	DstPort [2]byte
+}
+
+func (k *tcpConnKey) tuple() tcpTuple {
+	return tcpTuple{
+		SrcIP:   addrFrom16(k.SrcIP[:]),
+		DstIP:   addrFrom16(k.DstIP[:]),
+		SrcPort: binary.BigEndian.Uint16(k.SrcPort[:]),
+		DstPort: binary.BigEndian.Uint16(k.DstPort[:]),
+	}
+}
+
+// tcpConnState mirrors struct tcp_conn_state in monitor.c.
+type tcpConnState struct {
+	StartTS       uint64
+	EstablishedTS uint64
+	EndTS         uint64
+	SampleTS      uint64
+	SampleEnd     uint32
+	State         uint8
+	FinFlags      uint8
+	TCPFlags      uint8
+	SampleFrom    uint8
+}
+
+// tcpTuple identifies a TCP connection in either orientation.
+type tcpTuple struct {
+	SrcIP   netip.Addr
+	DstIP   netip.Addr
+	SrcPort uint16
+	DstPort uint16
+}
+
+// TCPConnection is a TCP connection tracked by the datapath.
+type TCPConnection struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	SourcePort  uint16
+	DestPort    uint16
+	State       string
+	// Flags is every TCP flag observed on the connection.
+	Flags uint8
+	// Duration runs from the handshake, or the first SYN if it never
+	// completed, to the close or reset, or to the first FIN for connections
+	// that timed out in FIN_WAIT; open connections count up to now.
+	Duration time.Duration
+	// Ended is set once the connection is closed or reset, or after
+	// finWaitTimeout in FIN_WAIT, which then remains its State.
+	Ended bool
+}
+
+// TCPEventCounts are the cumulative connection events counted in the kernel.
+// Connections already open when the agent started produce no open event.
+type TCPEventCounts struct {
+	Opens  uint64
+	Closes uint64
+	Resets uint64
+}
+
+// GetTCPConnections returns the tracked TCP connections. Each ended
+// connection is reported once. Closed and reset connections are removed
+// from the map after tcpTombstoneTimeout, and those that timed out in
+// FIN_WAIT as soon as they are read.
+func (c *Collector) GetTCPConnections() ([]TCPConnection, error) {
+	now, err := monotonicNow()
+	if err != nil {
+		return nil, err
+	}
+
+	dump, err := dumpMap[tcpConnKey, tcpConnState](c.tcpConnMap, c.features.BatchOps, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tcp_conn_map: %v", err)
+	}
+	c.recordEntries(mapIDTCPConn, len(dump.Keys))
+
+	c.tcpMu.Lock()
+	defer c.tcpMu.Unlock()
+	if c.reportedConns == nil {
+		c.reportedConns = make(map[tcpConnKey]uint64)
+	}
+	seen := make(map[tcpConnKey]bool, len(c.reportedConns))
+
+	var conns []TCPConnection
+	var ended []tcpConnKey
+	for i, key := range dump.Keys {
+		value := dump.Values[i]
+		tuple := key.tuple()
+		conn := TCPConnection{
+			Source:      tuple.SrcIP,
+			Destination: tuple.DstIP,
+			SourcePort:  tuple.SrcPort,
+			DestPort:    tuple.DstPort,
+			State:       tcpStateToString(value.State),
+			Flags:       value.TCPFlags,
+			Ended:       value.State == tcpStateClosed || value.State == tcpStateReset,
+		}
+		if value.State == tcpStateFinWait && now > value.EndTS && time.Duration(now-value.EndTS) > finWaitTimeout {
+			conn.Ended = true
+		}
+
+		start := value.StartTS
+		if value.EstablishedTS != 0 {
+			start = value.EstablishedTS
+		}
+		end := now
+		if conn.Ended {
+			end = value.EndTS
+			if value.State == tcpStateFinWait {
+				ended = append(ended, key)
+			} else {
+				// A tombstone keeps the EndTS it was reported with, while
+				// a new connection on the same tuple ends at another time
+				seen[key] = true
+				if time.Duration(now-value.EndTS) > tcpTombstoneTimeout {
+					ended = append(ended, key)
+				}
+				if c.reportedConns[key] == value.EndTS {
+					continue
+				}
+				c.reportedConns[key] = value.EndTS
+			}
+		}
+		if end > start {
+			conn.Duration = time.Duration(end - start)
+		}
+		conns = append(conns, conn)
+	}
+	// Forget tombstones that were removed, or evicted by the LRU
+	for key := range c.reportedConns {
+		if !seen[key] {
+			delete(c.reportedConns, key)
+		}
+	}
+
+	for i := range ended {
+		if err := c.tcpConnMap.Delete(&ended[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Failed to remove ended TCP connection: %v", err)
+		}
+	}
+	return conns, nil
+}
+
+// GetTCPEventCounts returns the connection opens, closes and resets counted
+// since the program was loaded.
+func (c *Collector) GetTCPEventCounts() (TCPEventCounts, error) {
+	var counts TCPEventCounts
+	for index, dst := range map[uint32]*uint64{
+		tcpEventOpen:  &counts.Opens,
+		tcpEventClose: &counts.Closes,
+		tcpEventReset: &counts.Resets,
+	} {
+		var values []uint64
+		if err := c.tcpEventsMap.Lookup(index, &values); err != nil {
+			return counts, fmt.Errorf("failed to read TCP event %d: %v", index, err)
+		}
+		*dst = sumPerCPU(values)
+	}
+	return counts, nil
+}
+
+// tcpStates reads the current state of every tracked connection, keyed by
+// its initiator-to-responder tuple.
+func (c *Collector) tcpStates() (map[tcpTuple]uint8, error) {
+	dump, err := dumpMap[tcpConnKey, tcpConnState](c.tcpConnMap, c.features.BatchOps, false)
+	if err != nil {
+		return nil, err
+	}
+	c.recordEntries(mapIDTCPConn, len(dump.Keys))
+	states := make(map[tcpTuple]uint8, len(dump.Keys))
+	for i, key := range dump.Keys {
+		states[key.tuple()] = dump.Values[i].State
+	}
+	return states, nil
+}
+
+// lookupTCPState finds the state of a connection seen from either end.
+func lookupTCPState(states map[tcpTuple]uint8, conn ConnectionInfo) (uint8, bool) {
+	if state, ok := states[tcpTuple{conn.SourceIP, conn.DestIP, conn.SourcePort, conn.DestPort}]; ok {
+		return state, true
+	}
+	state, ok := states[tcpTuple{conn.DestIP, conn.SourceIP, conn.DestPort, conn.SourcePort}]
+	return state, ok
+}
+
+func tcpStateToString(state uint8) string {
+	switch state {
+	case tcpStateSynSent:
+		return "SYN_SENT"
+	case tcpStateEstablished:
+		return "ESTABLISHED"
+	case tcpStateFinWait:
+		return "FIN_WAIT"
+	case tcpStateClosed:
+		return "CLOSED"
+	case tcpStateReset:
+		return "RESET"
+	default:
+		return "UNKNOWN"
+	}
+}
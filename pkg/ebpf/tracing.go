@@ -0,0 +1,74 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features"
+	"github.com/cilium/ebpf/link"
+)
+
+// The BTF tracepoint (tp_btf) programs are loaded separately from the packet
+// monitor, sharing its maps, so that kernels without BTF can still run it.
+
+// haveBTFTracing checks that the kernel can load tp_btf programs, which
+// needs the Tracing program type and kernel BTF.
+func haveBTFTracing() error {
+	if err := features.HaveProgramType(ebpf.Tracing); err != nil {
+		return err
+	}
+	_, err := btf.LoadKernelSpec()
+	return err
+}
+
+// attachTracing attaches every tracepoint program that was loaded. With
+// pinning enabled the links are pinned, so that they keep counting while the
+// collector restarts. Tracing links cannot swap programs, so the link of the
+// previous run is detached once the new one is attached: a drop in between
+// may be counted twice, rather than go uncounted.
+func (c *Collector) attachTracing() error {
+	tracing := &attachment{name: "tracepoints"}
+	programs := []struct {
+		name string
+		prog *ebpf.Program
+	}{
+		{"kfree_skb", c.kfreeSkb},
+		{"tcp_retransmit_skb", c.tcpRetransmitSkb},
+		{"tcp_retransmit_synack", c.tcpRetransmitSynack},
+	}
+	for _, p := range programs {
+		if p.prog == nil {
+			continue
+		}
+		l, err := link.AttachTracing(link.TracingOptions{Program: p.prog})
+		if err != nil {
+			tracing.Close()
+			return fmt.Errorf("failed to attach tracepoint program %s: %v", p.name, err)
+		}
+
+		path := c.tracingPin(p.name)
+		if path != "" {
+			if err := unpinLink(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Failed to detach pinned link %s: %v", path, err)
+			}
+			tracing.pins = append(tracing.pins, path)
+		}
+		tracing.hooks = append(tracing.hooks, pinLink(l, path))
+	}
+
+	c.mu.Lock()
+	c.tracing = tracing
+	c.mu.Unlock()
+	return nil
+}
+
+// tracingPin returns the pin path of the link of a tracepoint program, or ""
+// when pinning is disabled. Interface names cannot contain a colon, so it
+// never clashes with the pin of an interface.
+func (c *Collector) tracingPin(name string) string {
+	return c.linkPin("tracing:"+name, "tp_btf")
+}
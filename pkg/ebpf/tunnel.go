@@ -0,0 +1,97 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+
+	"github.com/cilium/ebpf"
+)
+
+// TunnelType identifies the encapsulation a flow was carried in, matching
+// TUNNEL_* in monitor.c.
+type TunnelType uint8
+
+const (
+	TunnelNone   TunnelType = 0
+	TunnelVXLAN  TunnelType = 1
+	TunnelGeneve TunnelType = 2
+	// TunnelIPIP is IPv4 or IPv6 carried directly in IPv4 or IPv6.
+	TunnelIPIP TunnelType = 3
+)
+
+func (t TunnelType) String() string {
+	switch t {
+	case TunnelNone:
+		return "none"
+	case TunnelVXLAN:
+		return "vxlan"
+	case TunnelGeneve:
+		return "geneve"
+	case TunnelIPIP:
+		return "ipip"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// Tunnel describes the overlay a flow was decapsulated from. Flows are keyed
+// on the inner addresses; Source and Destination are the outer addresses,
+// usually node IPs, of the most recent encapsulated packet.
+type Tunnel struct {
+	Type        TunnelType
+	Source      netip.Addr
+	Destination netip.Addr
+}
+
+// updateSkipDecapsulated stops recording decapsulated packets on the uplinks
+// while the collector is also attached to pod interfaces, so that a packet
+// is counted once, on the pod side, rather than once on each. The caller
+// holds mu.
+func (c *Collector) updateSkipDecapsulated() {
+	podSide := false
+	for _, a := range c.attachments {
+		podSide = podSide || a.podSide
+	}
+
+	skip := make(map[uint32]bool)
+	for _, a := range c.attachments {
+		if podSide && !a.podSide {
+			skip[uint32(a.ifindex)] = true
+		}
+	}
+
+	var ifindex uint32
+	var stale []uint32
+	entries := c.skipDecapMap.Iterate()
+	for entries.Next(&ifindex, new(uint8)) {
+		if !skip[ifindex] {
+			stale = append(stale, ifindex)
+		}
+	}
+	if err := entries.Err(); err != nil {
+		log.Printf("Failed to read skip_decapsulated: %v", err)
+	}
+	for _, ifindex := range stale {
+		if err := c.skipDecapMap.Delete(ifindex); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Failed to record decapsulated packets on ifindex %d: %v", ifindex, err)
+		}
+	}
+	for ifindex := range skip {
+		if err := c.skipDecapMap.Put(ifindex, uint8(1)); err != nil {
+			log.Printf("Failed to skip decapsulated packets on ifindex %d: %v", ifindex, err)
+		}
+	}
+}
+
+func newTunnel(value flowStats) Tunnel {
+	if TunnelType(value.TunnelType) == TunnelNone {
+		return Tunnel{}
+	}
+	return Tunnel{
+		Type:        TunnelType(value.TunnelType),
+		Source:      addrFrom16(value.TunnelSrc[:]),
+		Destination: addrFrom16(value.TunnelDst[:]),
+	}
+}
@@ -0,0 +1,93 @@
+package ebpf
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/cilium/ebpf/link"
+)
+
+// XDP modes selectable per interface. XDPModeAuto tries the driver's native
+// hook first and falls back to generic (skb) mode. Hardware offload is not
+// offered: the program relies on helpers and map types that offloading NICs
+// do not implement.
+const (
+	XDPModeAuto    = "auto"
+	XDPModeDriver  = "driver"
+	XDPModeGeneric = "generic"
+)
+
+// Attach modes recorded for XDP attachments.
+const (
+	modeXDPDriver  = "xdp-driver"
+	modeXDPGeneric = "xdp-generic"
+)
+
+type xdpAttempt struct {
+	mode  string
+	flags link.XDPAttachFlags
+}
+
+func xdpAttempts(xdpMode string) ([]xdpAttempt, error) {
+	driver := xdpAttempt{modeXDPDriver, link.XDPDriverMode}
+	generic := xdpAttempt{modeXDPGeneric, link.XDPGenericMode}
+
+	switch xdpMode {
+	case "", XDPModeAuto:
+		return []xdpAttempt{driver, generic}, nil
+	case XDPModeDriver:
+		return []xdpAttempt{driver}, nil
+	case XDPModeGeneric:
+		return []xdpAttempt{generic}, nil
+	default:
+		return nil, fmt.Errorf("unknown XDP mode %q", xdpMode)
+	}
+}
+
+// attachXDP attaches the XDP program to a in the requested mode, falling
+// back from native to generic mode when the driver lacks XDP support.
+func (c *Collector) attachXDP(a *attachment, xdpMode string) error {
+	if !c.features.XDP {
+		return fmt.Errorf("kernel does not support XDP programs")
+	}
+
+	attempts, err := xdpAttempts(xdpMode)
+	if err != nil {
+		return err
+	}
+
+	// Take over a link pinned by a previous run in any of the modes allowed
+	for _, attempt := range attempts {
+		pin := c.linkPin(a.name, attempt.mode)
+		if l := takeOverLink(pin, a.ifindex, c.program); l != nil {
+			a.mode = attempt.mode
+			a.hooks = append(a.hooks, pinnedLink{l})
+			a.pins = append(a.pins, pin)
+			return nil
+		}
+	}
+
+	var lastErr error
+	for i, attempt := range attempts {
+		l, err := link.AttachXDP(link.XDPOptions{
+			Program:   c.program,
+			Interface: a.ifindex,
+			Flags:     attempt.flags,
+		})
+		if err == nil {
+			if i > 0 {
+				log.Printf("Interface %s is degraded: running XDP in %s mode", a.name, attempt.mode)
+			}
+			pin := c.linkPin(a.name, attempt.mode)
+			a.mode = attempt.mode
+			a.hooks = append(a.hooks, pinLink(l, pin))
+			a.pins = append(a.pins, pin)
+			return nil
+		}
+		lastErr = fmt.Errorf("%s: %v", attempt.mode, err)
+		if i < len(attempts)-1 {
+			log.Printf("XDP %s mode failed on %s, falling back: %v", attempt.mode, a.name, err)
+		}
+	}
+	return lastErr
+}
@@ -2,16 +2,40 @@ package kubernetes
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// ErrCacheNotSynced is returned by lookups made before the informer caches
+// have completed their initial list.
+var ErrCacheNotSynced = errors.New("kubernetes cache not synced")
+
+const defaultResync = 10 * time.Minute
+
 type Client struct {
-	clientset *kubernetes.Clientset
+	clientset kubernetes.Interface
+	factory   informers.SharedInformerFactory
+
+	namespaceInformer     cache.SharedIndexInformer
+	podInformer           cache.SharedIndexInformer
+	serviceInformer       cache.SharedIndexInformer
+	endpointSliceInformer cache.SharedIndexInformer
+	// ReplicaSets and Jobs are only watched to walk pod owner references.
+	replicaSetInformer cache.SharedIndexInformer
+	jobInformer        cache.SharedIndexInformer
+
+	history        *ipHistory
+	workloadLabels []string
 }
 
 func NewClient() (*Client, error) {
@@ -29,70 +53,194 @@ func NewClient() (*Client, error) {
 		return nil, fmt.Errorf("failed to create Kubernetes client: %v", err)
 	}
 
-	return &Client{clientset: clientset}, nil
+	return NewClientForClientset(clientset, defaultResync)
+}
+
+// NewClientForClientset builds a Client on top of an existing clientset, such
+// as the one returned by k8s.io/client-go/kubernetes/fake.
+func NewClientForClientset(clientset kubernetes.Interface, resync time.Duration) (*Client, error) {
+	factory := informers.NewSharedInformerFactory(clientset, resync)
+
+	c := &Client{
+		clientset:             clientset,
+		factory:               factory,
+		namespaceInformer:     factory.Core().V1().Namespaces().Informer(),
+		podInformer:           factory.Core().V1().Pods().Informer(),
+		serviceInformer:       factory.Core().V1().Services().Informer(),
+		endpointSliceInformer: factory.Discovery().V1().EndpointSlices().Informer(),
+		replicaSetInformer:    factory.Apps().V1().ReplicaSets().Informer(),
+		jobInformer:           factory.Batch().V1().Jobs().Informer(),
+		history:               newIPHistory(defaultHistoryRetention),
+		workloadLabels:        DefaultWorkloadLabels,
+	}
+
+	if err := c.podInformer.AddIndexers(cache.Indexers{podIPIndex: indexPodByIP}); err != nil {
+		return nil, fmt.Errorf("failed to add pod IP index: %v", err)
+	}
+	if err := c.serviceInformer.AddIndexers(cache.Indexers{serviceIPIndex: indexServiceByIP}); err != nil {
+		return nil, fmt.Errorf("failed to add service IP index: %v", err)
+	}
+	if err := c.endpointSliceInformer.AddIndexers(cache.Indexers{
+		endpointSliceIPIndex:      indexEndpointSliceByIP,
+		endpointSliceServiceIndex: indexEndpointSliceByService,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to add endpoint slice indexes: %v", err)
+	}
+	if _, err := c.podInformer.AddEventHandler(c.history.eventHandler()); err != nil {
+		return nil, fmt.Errorf("failed to add pod IP history handler: %v", err)
+	}
+
+	return c, nil
+}
+
+// Start runs the informers until ctx is cancelled. It does not block.
+func (c *Client) Start(ctx context.Context) {
+	c.factory.Start(ctx.Done())
+	go wait.UntilWithContext(ctx, func(context.Context) { c.history.prune() }, time.Minute)
+}
+
+// WaitForCacheSync blocks until every informer has completed its initial
+// list or ctx is done, and reports whether the caches are ready.
+func (c *Client) WaitForCacheSync(ctx context.Context) bool {
+	return cache.WaitForCacheSync(ctx.Done(), c.informerSyncs()...)
+}
+
+// HasSynced reports whether every informer has completed its initial list.
+func (c *Client) HasSynced() bool {
+	for _, synced := range c.informerSyncs() {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Client) informerSyncs() []cache.InformerSynced {
+	return []cache.InformerSynced{
+		c.namespaceInformer.HasSynced,
+		c.podInformer.HasSynced,
+		c.serviceInformer.HasSynced,
+		c.endpointSliceInformer.HasSynced,
+		c.replicaSetInformer.HasSynced,
+		c.jobInformer.HasSynced,
+	}
 }
 
 func (c *Client) GetNamespaces() ([]string, error) {
-	namespaces, err := c.clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+	if !c.HasSynced() {
+		return nil, ErrCacheNotSynced
+	}
+	namespaces, err := c.factory.Core().V1().Namespaces().Lister().List(labels.Everything())
 	if err != nil {
 		return nil, fmt.Errorf("failed to list namespaces: %v", err)
 	}
 
 	var namespaceNames []string
-	for _, ns := range namespaces.Items {
+	for _, ns := range namespaces {
 		namespaceNames = append(namespaceNames, ns.Name)
 	}
 	return namespaceNames, nil
 }
 
 func (c *Client) GetPods(namespace string) ([]string, error) {
-	pods, err := c.clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+	if !c.HasSynced() {
+		return nil, ErrCacheNotSynced
+	}
+	pods, err := c.factory.Core().V1().Pods().Lister().Pods(namespace).List(labels.Everything())
 	if err != nil {
 		return nil, fmt.Errorf("failed to list pods: %v", err)
 	}
 
 	var podNames []string
-	for _, pod := range pods.Items {
+	for _, pod := range pods {
 		podNames = append(podNames, pod.Name)
 	}
 	return podNames, nil
 }
 
 func (c *Client) GetServices(namespace string) ([]string, error) {
-	services, err := c.clientset.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{})
+	if !c.HasSynced() {
+		return nil, ErrCacheNotSynced
+	}
+	services, err := c.factory.Core().V1().Services().Lister().Services(namespace).List(labels.Everything())
 	if err != nil {
 		return nil, fmt.Errorf("failed to list services: %v", err)
 	}
 
 	var serviceNames []string
-	for _, service := range services.Items {
+	for _, service := range services {
 		serviceNames = append(serviceNames, service.Name)
 	}
 	return serviceNames, nil
 }
 
 func (c *Client) GetPodByIP(ip string) (string, string, error) {
-    pods, err := c.clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
-        FieldSelector: fmt.Sprintf("status.podIP=%s", ip),
-    })
-    if err != nil {
-        return "", "", err
-    }
-    if len(pods.Items) > 0 {
-        return pods.Items[0].Name, pods.Items[0].Namespace, nil
-    }
-    return "", "", fmt.Errorf("no pod found with IP %s", ip)
+	objs, err := c.lookupByIP(c.podInformer, podIPIndex, ip)
+	if err != nil {
+		return "", "", err
+	}
+	var pod *corev1.Pod
+	for _, obj := range objs {
+		p := obj.(*corev1.Pod)
+		if pod == nil || preferPodForIP(p, pod) {
+			pod = p
+		}
+	}
+	if pod != nil {
+		return pod.Name, pod.Namespace, nil
+	}
+	return "", "", fmt.Errorf("no pod found with IP %s", ip)
+}
+
+// preferPodForIP reports whether a is a better owner of a shared IP than b,
+// so that the choice does not depend on the order of the index. A running
+// pod wins over a terminated one still holding the IP, then the pod that
+// started last, then the first by namespace and name.
+func preferPodForIP(a, b *corev1.Pod) bool {
+	aRunning, bRunning := a.Status.Phase == corev1.PodRunning, b.Status.Phase == corev1.PodRunning
+	if aRunning != bRunning {
+		return aRunning
+	}
+	if aStart, bStart := podStartTime(a), podStartTime(b); !aStart.Equal(bStart) {
+		return aStart.After(bStart)
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+// GetPodByIPAt returns the pod that owned ip at ts, which may be a pod that
+// has since been deleted and whose IP now belongs to another pod.
+func (c *Client) GetPodByIPAt(ip string, ts time.Time) (string, string, error) {
+	if !c.podInformer.HasSynced() {
+		return "", "", ErrCacheNotSynced
+	}
+	if owner, ok := c.history.resolve(ip, ts); ok {
+		return owner.Name, owner.Namespace, nil
+	}
+	return "", "", fmt.Errorf("no pod owned IP %s at %s", ip, ts.Format(time.RFC3339))
 }
 
 func (c *Client) GetServiceByIP(ip string) (string, string, error) {
-    services, err := c.clientset.CoreV1().Services("").List(context.TODO(), metav1.ListOptions{
-        FieldSelector: fmt.Sprintf("spec.clusterIP=%s", ip),
-    })
-    if err != nil {
-        return "", "", err
-    }
-    if len(services.Items) > 0 {
-        return services.Items[0].Name, services.Items[0].Namespace, nil
-    }
-    return "", "", fmt.Errorf("no service found with IP %s", ip)
-}
\ No newline at end of file
+	objs, err := c.lookupByIP(c.serviceInformer, serviceIPIndex, ip)
+	if err != nil {
+		return "", "", err
+	}
+	if len(objs) > 0 {
+		service := objs[0].(*corev1.Service)
+		return service.Name, service.Namespace, nil
+	}
+	return "", "", fmt.Errorf("no service found with IP %s", ip)
+}
+
+func (c *Client) lookupByIP(informer cache.SharedIndexInformer, index, ip string) ([]interface{}, error) {
+	if !informer.HasSynced() {
+		return nil, ErrCacheNotSynced
+	}
+	objs, err := informer.GetIndexer().ByIndex(index, normalizeIP(ip))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s %s: %v", index, ip, err)
+	}
+	return objs, nil
+}
@@ -0,0 +1,201 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestPod(namespace, name, ip string, phase corev1.PodPhase, start time.Time) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, UID: types.UID(namespace + "/" + name)},
+		Status: corev1.PodStatus{
+			Phase:     phase,
+			PodIP:     ip,
+			PodIPs:    []corev1.PodIP{{IP: ip}},
+			StartTime: &metav1.Time{Time: start},
+		},
+	}
+}
+
+// startTestClient returns a synced Client serving objects from a fake
+// clientset.
+func startTestClient(t *testing.T, objects ...runtime.Object) *Client {
+	t.Helper()
+	c, err := NewClientForClientset(fake.NewSimpleClientset(objects...), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c.Start(ctx)
+
+	syncCtx, syncCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer syncCancel()
+	if !c.WaitForCacheSync(syncCtx) {
+		t.Fatal("caches did not sync")
+	}
+	return c
+}
+
+func TestClientNotSynced(t *testing.T) {
+	c, err := NewClientForClientset(fake.NewSimpleClientset(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HasSynced() {
+		t.Error("HasSynced is true before the informers started")
+	}
+	if _, _, err := c.GetPodByIP("10.0.0.1"); !errors.Is(err, ErrCacheNotSynced) {
+		t.Errorf("GetPodByIP returned %v, want ErrCacheNotSynced", err)
+	}
+	if _, _, err := c.GetServiceByIP("10.96.0.1"); !errors.Is(err, ErrCacheNotSynced) {
+		t.Errorf("GetServiceByIP returned %v, want ErrCacheNotSynced", err)
+	}
+	if _, err := c.GetNamespaces(); !errors.Is(err, ErrCacheNotSynced) {
+		t.Errorf("GetNamespaces returned %v, want ErrCacheNotSynced", err)
+	}
+}
+
+func TestClientIPIndexes(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	dualStack := newTestPod("default", "web", "10.0.0.1", corev1.PodRunning, start)
+	dualStack.Status.PodIPs = append(dualStack.Status.PodIPs, corev1.PodIP{IP: "fd00:0:0:0::1"})
+	hostNetwork := newTestPod("kube-system", "proxy", "192.168.0.10", corev1.PodRunning, start)
+	hostNetwork.Spec.HostNetwork = true
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.10", ClusterIPs: []string{"10.96.0.10", "fd00:96::a"}},
+	}
+	headless := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{ClusterIP: corev1.ClusterIPNone},
+	}
+	c := startTestClient(t, dualStack, hostNetwork, service, headless)
+
+	if !c.HasSynced() {
+		t.Error("HasSynced is false after the caches synced")
+	}
+	for _, ip := range []string{"10.0.0.1", "fd00::1", "::ffff:10.0.0.1"} {
+		name, namespace, err := c.GetPodByIP(ip)
+		if err != nil || name != "web" || namespace != "default" {
+			t.Errorf("GetPodByIP(%s) = %s/%s, %v, want default/web", ip, namespace, name, err)
+		}
+	}
+	if _, _, err := c.GetPodByIP("192.168.0.10"); err == nil {
+		t.Error("GetPodByIP found a host-network pod by the node IP")
+	}
+	for _, ip := range []string{"10.96.0.10", "fd00:96::a"} {
+		name, namespace, err := c.GetServiceByIP(ip)
+		if err != nil || name != "web" || namespace != "default" {
+			t.Errorf("GetServiceByIP(%s) = %s/%s, %v, want default/web", ip, namespace, name, err)
+		}
+	}
+	if _, _, err := c.GetServiceByIP(corev1.ClusterIPNone); err == nil {
+		t.Error("GetServiceByIP found a headless service")
+	}
+}
+
+func TestGetPodByIPPrefersNewestRunningPod(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		pods []*corev1.Pod
+		want string
+	}{
+		{
+			name: "running over terminated",
+			pods: []*corev1.Pod{
+				newTestPod("default", "old", "10.0.0.1", corev1.PodSucceeded, start.Add(time.Hour)),
+				newTestPod("default", "new", "10.0.0.1", corev1.PodRunning, start),
+			},
+			want: "new",
+		},
+		{
+			name: "newest start time among running",
+			pods: []*corev1.Pod{
+				newTestPod("default", "a", "10.0.0.1", corev1.PodRunning, start.Add(time.Minute)),
+				newTestPod("default", "b", "10.0.0.1", corev1.PodRunning, start),
+				newTestPod("default", "c", "10.0.0.1", corev1.PodRunning, start.Add(2*time.Minute)),
+			},
+			want: "c",
+		},
+		{
+			name: "name breaks a tie",
+			pods: []*corev1.Pod{
+				newTestPod("default", "b", "10.0.0.1", corev1.PodRunning, start),
+				newTestPod("default", "a", "10.0.0.1", corev1.PodRunning, start),
+			},
+			want: "a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []runtime.Object
+			for _, pod := range tt.pods {
+				objects = append(objects, pod)
+			}
+			c := startTestClient(t, objects...)
+			// The index returns pods in no particular order, so repeat the
+			// lookup to catch a choice that depends on it
+			for i := 0; i < 10; i++ {
+				name, _, err := c.GetPodByIP("10.0.0.1")
+				if err != nil || name != tt.want {
+					t.Fatalf("GetPodByIP = %s, %v, want %s", name, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetPodByIPAt(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	released := t0.Add(time.Minute)
+	reused := t0.Add(2 * time.Minute)
+
+	clientset := fake.NewSimpleClientset(newTestPod("default", "old", "10.0.0.1", corev1.PodRunning, t0))
+	c, err := NewClientForClientset(clientset, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.history.now = func() time.Time { return released }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.Start(ctx)
+	if !c.WaitForCacheSync(ctx) {
+		t.Fatal("caches did not sync")
+	}
+
+	// The IP moves to a new pod after the old one is deleted
+	if err := clientset.CoreV1().Pods("default").Delete(ctx, "old", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	newPod := newTestPod("default", "new", "10.0.0.1", corev1.PodRunning, reused)
+	if _, err := clientset.CoreV1().Pods("default").Create(ctx, newPod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if name, _, _ := c.GetPodByIPAt("10.0.0.1", reused.Add(time.Second)); name == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the new pod never showed up in the IP history")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if name, _, err := c.GetPodByIPAt("10.0.0.1", t0.Add(30*time.Second)); err != nil || name != "old" {
+		t.Errorf("GetPodByIPAt before the reuse = %s, %v, want old", name, err)
+	}
+	if name, _, err := c.GetPodByIPAt("10.0.0.1", reused.Add(time.Second)); err != nil || name != "new" {
+		t.Errorf("GetPodByIPAt after the reuse = %s, %v, want new", name, err)
+	}
+}
@@ -0,0 +1,193 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net/netip"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+const (
+	endpointSliceIPIndex      = "endpointSliceIP"
+	endpointSliceServiceIndex = "endpointSliceService"
+)
+
+// ServiceBackend describes a flow destination resolved through a Service.
+// BackendPod is set when the destination is a backend address, or when the
+// Service has exactly one ready endpoint so the DNAT target is unambiguous.
+type ServiceBackend struct {
+	Service        string
+	Namespace      string
+	PortName       string
+	BackendPod     string
+	ReadyEndpoints int
+}
+
+func indexEndpointSliceByIP(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return nil, nil
+	}
+	var ips []string
+	for _, endpoint := range slice.Endpoints {
+		for _, addr := range endpoint.Addresses {
+			ips = append(ips, normalizeIP(addr))
+		}
+	}
+	return ips, nil
+}
+
+func indexEndpointSliceByService(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return nil, nil
+	}
+	service := slice.Labels[discoveryv1.LabelServiceName]
+	if service == "" {
+		return nil, nil
+	}
+	return []string{slice.Namespace + "/" + service}, nil
+}
+
+// ResolveServiceBackend maps a destination address and port to the Service
+// behind it. ip may be a ClusterIP or the address of one of its endpoints.
+func (c *Client) ResolveServiceBackend(ip string, port uint16) (*ServiceBackend, bool) {
+	if objs, err := c.lookupByIP(c.serviceInformer, serviceIPIndex, ip); err == nil && len(objs) > 0 {
+		service := objs[0].(*corev1.Service)
+		backend := &ServiceBackend{
+			Service:   service.Name,
+			Namespace: service.Namespace,
+			PortName:  servicePortName(service, port),
+		}
+		var ready []discoveryv1.Endpoint
+		for _, slice := range c.endpointSlicesForService(service.Namespace, service.Name, addressType(ip)) {
+			for _, endpoint := range slice.Endpoints {
+				if endpointReady(endpoint) {
+					ready = append(ready, endpoint)
+				}
+			}
+		}
+		backend.ReadyEndpoints = len(ready)
+		if len(ready) == 1 {
+			backend.BackendPod = endpointPodName(ready[0])
+		}
+		return backend, true
+	}
+
+	objs, err := c.lookupByIP(c.endpointSliceInformer, endpointSliceIPIndex, ip)
+	if err != nil || len(objs) == 0 {
+		return nil, false
+	}
+	for _, obj := range objs {
+		slice := obj.(*discoveryv1.EndpointSlice)
+		portName, ok := endpointSlicePortName(slice, port)
+		if !ok {
+			continue
+		}
+		backend := &ServiceBackend{
+			Service:   slice.Labels[discoveryv1.LabelServiceName],
+			Namespace: slice.Namespace,
+			PortName:  portName,
+		}
+		for _, other := range c.endpointSlicesForService(backend.Namespace, backend.Service, slice.AddressType) {
+			for _, endpoint := range other.Endpoints {
+				if endpointReady(endpoint) {
+					backend.ReadyEndpoints++
+				}
+				if endpointHasAddress(endpoint, ip) {
+					backend.BackendPod = endpointPodName(endpoint)
+				}
+			}
+		}
+		return backend, true
+	}
+	return nil, false
+}
+
+// GetServiceByEndpointIP returns the service whose endpoints include ip.
+func (c *Client) GetServiceByEndpointIP(ip string) (string, string, error) {
+	objs, err := c.lookupByIP(c.endpointSliceInformer, endpointSliceIPIndex, ip)
+	if err != nil {
+		return "", "", err
+	}
+	for _, obj := range objs {
+		slice := obj.(*discoveryv1.EndpointSlice)
+		if service := slice.Labels[discoveryv1.LabelServiceName]; service != "" {
+			return service, slice.Namespace, nil
+		}
+	}
+	return "", "", fmt.Errorf("no endpoints found with IP %s", ip)
+}
+
+// endpointSlicesForService returns the slices of a service holding addresses
+// of one family. A dual-stack service has a slice per family listing the
+// same pods, so counting both would count every endpoint twice.
+func (c *Client) endpointSlicesForService(namespace, name string, family discoveryv1.AddressType) []*discoveryv1.EndpointSlice {
+	objs, err := c.endpointSliceInformer.GetIndexer().ByIndex(endpointSliceServiceIndex, namespace+"/"+name)
+	if err != nil {
+		return nil
+	}
+	slices := make([]*discoveryv1.EndpointSlice, 0, len(objs))
+	for _, obj := range objs {
+		slice := obj.(*discoveryv1.EndpointSlice)
+		if slice.AddressType == family {
+			slices = append(slices, slice)
+		}
+	}
+	return slices
+}
+
+// addressType returns the EndpointSlice address type of ip's family.
+func addressType(ip string) discoveryv1.AddressType {
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Unmap().Is4() {
+		return discoveryv1.AddressTypeIPv4
+	}
+	return discoveryv1.AddressTypeIPv6
+}
+
+// endpointReady follows the EndpointSlice API convention that a nil ready
+// condition means the endpoint is ready.
+func endpointReady(endpoint discoveryv1.Endpoint) bool {
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+func endpointHasAddress(endpoint discoveryv1.Endpoint, ip string) bool {
+	for _, addr := range endpoint.Addresses {
+		if normalizeIP(addr) == normalizeIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func endpointPodName(endpoint discoveryv1.Endpoint) string {
+	if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+		return endpoint.TargetRef.Name
+	}
+	return ""
+}
+
+func servicePortName(service *corev1.Service, port uint16) string {
+	for _, p := range service.Spec.Ports {
+		if p.Port == int32(port) {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+func endpointSlicePortName(slice *discoveryv1.EndpointSlice, port uint16) (string, bool) {
+	if len(slice.Ports) == 0 {
+		return "", true
+	}
+	for _, p := range slice.Ports {
+		if p.Port != nil && *p.Port == int32(port) {
+			if p.Name != nil {
+				return *p.Name, true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,52 @@
+package kubernetes
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestEndpointSlice(name string, family discoveryv1.AddressType, addrs ...string) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		AddressType: family,
+	}
+	for i, addr := range addrs {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses: []string{addr},
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: []string{"web-a", "web-b"}[i]},
+		})
+	}
+	return slice
+}
+
+func TestResolveServiceBackendDualStack(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			ClusterIPs: []string{"10.96.0.10", "fd00:96::a"},
+			Ports:      []corev1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+	c := startTestClient(t, service,
+		newTestEndpointSlice("web-v4", discoveryv1.AddressTypeIPv4, "10.0.0.1", "10.0.0.2"),
+		newTestEndpointSlice("web-v6", discoveryv1.AddressTypeIPv6, "fd00::1", "fd00::2"),
+	)
+
+	for _, ip := range []string{"10.96.0.10", "fd00:96::a", "10.0.0.1", "fd00::2"} {
+		backend, ok := c.ResolveServiceBackend(ip, 80)
+		if !ok {
+			t.Errorf("ResolveServiceBackend(%s) found no service", ip)
+			continue
+		}
+		if backend.Service != "web" || backend.ReadyEndpoints != 2 {
+			t.Errorf("ResolveServiceBackend(%s) = %s with %d ready endpoints, want web with 2", ip, backend.Service, backend.ReadyEndpoints)
+		}
+	}
+}
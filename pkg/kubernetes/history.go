@@ -0,0 +1,241 @@
+package kubernetes
+
+import (
+	"maps"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// defaultHistoryRetention is how long a released IP keeps its tombstone, so
+// that counters read after a pod is gone can still be attributed to it.
+const defaultHistoryRetention = 15 * time.Minute
+
+// ipOwnership records that a pod held an IP during [From, To). A zero To
+// means the pod still holds the IP.
+type ipOwnership struct {
+	UID             types.UID
+	Name            string
+	Namespace       string
+	Labels          map[string]string
+	OwnerReferences []metav1.OwnerReference
+	From            time.Time
+	To              time.Time
+}
+
+func (o *ipOwnership) released() bool {
+	return !o.To.IsZero()
+}
+
+func (o *ipOwnership) covers(ts time.Time) bool {
+	return !ts.Before(o.From) && (!o.released() || ts.Before(o.To))
+}
+
+// ipHistory keeps the ownership intervals of every pod IP, ordered by start
+// time, fed from the pod informer's watch events.
+type ipHistory struct {
+	mu        sync.RWMutex
+	byIP      map[string][]*ipOwnership
+	retention time.Duration
+	now       func() time.Time
+}
+
+func newIPHistory(retention time.Duration) *ipHistory {
+	return &ipHistory{
+		byIP:      make(map[string][]*ipOwnership),
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+func (h *ipHistory) eventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				h.observe(pod)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, ok := oldObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			newPod, ok := newObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			for _, ip := range podIPs(oldPod) {
+				if !containsString(podIPs(newPod), ip) || !podHoldsIP(newPod) {
+					h.release(ip, oldPod.UID, h.now())
+				}
+			}
+			h.observe(newPod)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			for _, ip := range podIPs(pod) {
+				h.release(ip, pod.UID, h.now())
+			}
+		},
+	}
+}
+
+// observe opens an ownership interval for each IP the pod currently holds.
+func (h *ipHistory) observe(pod *corev1.Pod) {
+	if !podHoldsIP(pod) {
+		return
+	}
+	from := podStartTime(pod)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ip := range podIPs(pod) {
+		entries := h.byIP[ip]
+		if hasEntry(entries, pod.UID, from) {
+			continue
+		}
+		owner := &ipOwnership{
+			UID:             pod.UID,
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			Labels:          maps.Clone(pod.Labels),
+			OwnerReferences: podOwnerReferences(pod),
+			From:            from,
+		}
+		// A new owner implies that the owners before it released the IP,
+		// even if their delete events have not arrived yet. Events can
+		// arrive out of order, so an owner that started later ends this
+		// one instead.
+		for _, e := range entries {
+			switch {
+			case e.From.Before(from):
+				if !e.released() {
+					e.To = from
+				}
+			case e.From.After(from):
+				if !owner.released() || e.From.Before(owner.To) {
+					owner.To = e.From
+				}
+			}
+		}
+		entries = append(entries, owner)
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].From.Before(entries[j].From) })
+		h.byIP[ip] = entries
+	}
+}
+
+// hasEntry reports whether entries already hold the interval of uid starting
+// at from, or an open one of uid. An interval closed because a later owner
+// showed up still belongs to the same pod, so it is not opened again.
+func hasEntry(entries []*ipOwnership, uid types.UID, from time.Time) bool {
+	for _, e := range entries {
+		if e.UID == uid && (!e.released() || e.From.Equal(from)) {
+			return true
+		}
+	}
+	return false
+}
+
+// release tombstones the open interval of uid on ip.
+func (h *ipHistory) release(ip string, uid types.UID, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range h.byIP[ip] {
+		if e.UID == uid && !e.released() {
+			e.To = at
+		}
+	}
+}
+
+// resolve returns the pod that owned ip at ts. When no interval covers ts and
+// the most recent owner has already released the IP, that owner is returned
+// so traffic read after a pod's deletion is still attributed to it.
+func (h *ipHistory) resolve(ip string, ts time.Time) (*ipOwnership, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	entries := h.byIP[normalizeIP(ip)]
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].covers(ts) {
+			owner := *entries[i]
+			return &owner, true
+		}
+	}
+	if n := len(entries); n > 0 && entries[n-1].released() && !ts.Before(entries[n-1].To) {
+		owner := *entries[n-1]
+		return &owner, true
+	}
+	return nil, false
+}
+
+// prune drops tombstones that are older than the retention period.
+func (h *ipHistory) prune() {
+	cutoff := h.now().Add(-h.retention)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ip, entries := range h.byIP {
+		kept := entries[:0]
+		for _, e := range entries {
+			if !e.released() || e.To.After(cutoff) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(h.byIP, ip)
+		} else {
+			h.byIP[ip] = kept
+		}
+	}
+}
+
+// podIPs returns every address of the pod from status.podIPs, falling back to
+// status.podIP. Host-network pods share the node IP, so they cannot be told
+// apart by address and are skipped.
+func podIPs(pod *corev1.Pod) []string {
+	if pod.Spec.HostNetwork {
+		return nil
+	}
+	var ips []string
+	for _, podIP := range pod.Status.PodIPs {
+		if podIP.IP != "" {
+			ips = append(ips, normalizeIP(podIP.IP))
+		}
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, normalizeIP(pod.Status.PodIP))
+	}
+	return ips
+}
+
+// podHoldsIP reports whether the pod's sandbox, and therefore its IP, is still
+// allocated. Pods in a terminal phase have released their IP to the CNI.
+func podHoldsIP(pod *corev1.Pod) bool {
+	return pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+func podStartTime(pod *corev1.Pod) time.Time {
+	if pod.Status.StartTime != nil {
+		return pod.Status.StartTime.Time
+	}
+	return pod.CreationTimestamp.Time
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package kubernetes
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestIPHistoryObserve(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Minute)
+	t2 := t0.Add(2 * time.Minute)
+
+	type interval struct {
+		name     string
+		from, to time.Time
+	}
+	tests := []struct {
+		name    string
+		observe []*corev1.Pod
+		want    []interval
+	}{
+		{
+			name:    "new owner closes the previous one",
+			observe: []*corev1.Pod{newTestPod("default", "a", "10.0.0.1", corev1.PodRunning, t0), newTestPod("default", "b", "10.0.0.1", corev1.PodRunning, t1)},
+			want:    []interval{{"a", t0, t1}, {"b", t1, time.Time{}}},
+		},
+		{
+			name:    "repeated event of an open owner",
+			observe: []*corev1.Pod{newTestPod("default", "a", "10.0.0.1", corev1.PodRunning, t0), newTestPod("default", "b", "10.0.0.1", corev1.PodRunning, t1), newTestPod("default", "a", "10.0.0.1", corev1.PodRunning, t0)},
+			want:    []interval{{"a", t0, t1}, {"b", t1, time.Time{}}},
+		},
+		{
+			name:    "late event of an earlier owner",
+			observe: []*corev1.Pod{newTestPod("default", "b", "10.0.0.1", corev1.PodRunning, t1), newTestPod("default", "a", "10.0.0.1", corev1.PodRunning, t0)},
+			want:    []interval{{"a", t0, t1}, {"b", t1, time.Time{}}},
+		},
+		{
+			name:    "late event between two owners",
+			observe: []*corev1.Pod{newTestPod("default", "a", "10.0.0.1", corev1.PodRunning, t0), newTestPod("default", "c", "10.0.0.1", corev1.PodRunning, t2), newTestPod("default", "b", "10.0.0.1", corev1.PodRunning, t1)},
+			want:    []interval{{"a", t0, t2}, {"b", t1, t2}, {"c", t2, time.Time{}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newIPHistory(defaultHistoryRetention)
+			for _, pod := range tt.observe {
+				h.observe(pod)
+			}
+			entries := h.byIP["10.0.0.1"]
+			if len(entries) != len(tt.want) {
+				t.Fatalf("got %d intervals, want %d", len(entries), len(tt.want))
+			}
+			for i, e := range entries {
+				want := tt.want[i]
+				if e.Name != want.name || !e.From.Equal(want.from) || !e.To.Equal(want.to) {
+					t.Errorf("interval %d is %s [%v, %v), want %s [%v, %v)", i, e.Name, e.From, e.To, want.name, want.from, want.to)
+				}
+				if e.released() && e.To.Before(e.From) {
+					t.Errorf("interval %d ends before it starts", i)
+				}
+			}
+		})
+	}
+}
+
+func TestIPHistoryResolve(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	released := t0.Add(time.Minute)
+	reused := t0.Add(2 * time.Minute)
+
+	h := newIPHistory(defaultHistoryRetention)
+	h.observe(newTestPod("default", "old", "10.0.0.1", corev1.PodRunning, t0))
+	h.release("10.0.0.1", "default/old", released)
+	h.observe(newTestPod("default", "new", "10.0.0.1", corev1.PodRunning, reused))
+	h.observe(newTestPod("default", "gone", "10.0.0.2", corev1.PodRunning, t0))
+	h.release("10.0.0.2", "default/gone", released)
+
+	tests := []struct {
+		name string
+		ip   string
+		ts   time.Time
+		want string
+	}{
+		{"inside a released interval", "10.0.0.1", t0.Add(30 * time.Second), "old"},
+		{"between release and reuse", "10.0.0.1", released.Add(time.Second), ""},
+		{"after reuse", "10.0.0.1", reused.Add(time.Second), "new"},
+		{"before any owner", "10.0.0.1", t0.Add(-time.Second), ""},
+		{"past the release of the last owner", "10.0.0.2", released.Add(time.Hour), "gone"},
+		{"unknown IP", "10.0.0.3", t0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner, ok := h.resolve(tt.ip, tt.ts)
+			switch {
+			case tt.want == "" && ok:
+				t.Errorf("resolve(%s, %v) = %s, want no owner", tt.ip, tt.ts, owner.Name)
+			case tt.want != "" && !ok:
+				t.Errorf("resolve(%s, %v) found no owner, want %s", tt.ip, tt.ts, tt.want)
+			case ok && owner.Name != tt.want:
+				t.Errorf("resolve(%s, %v) = %s, want %s", tt.ip, tt.ts, owner.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPHistoryPrune(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := t0.Add(time.Hour)
+
+	h := newIPHistory(15 * time.Minute)
+	h.now = func() time.Time { return now }
+	h.observe(newTestPod("default", "expired", "10.0.0.1", corev1.PodRunning, t0))
+	h.release("10.0.0.1", "default/expired", now.Add(-20*time.Minute))
+	h.observe(newTestPod("default", "recent", "10.0.0.1", corev1.PodRunning, now.Add(-19*time.Minute)))
+	h.release("10.0.0.1", "default/recent", now.Add(-10*time.Minute))
+	h.observe(newTestPod("default", "open", "10.0.0.2", corev1.PodRunning, t0))
+	h.observe(newTestPod("default", "alone", "10.0.0.3", corev1.PodRunning, t0))
+	h.release("10.0.0.3", "default/alone", now.Add(-time.Hour))
+
+	h.prune()
+
+	var names []string
+	for _, e := range h.byIP["10.0.0.1"] {
+		names = append(names, e.Name)
+	}
+	if len(names) != 1 || names[0] != "recent" {
+		t.Errorf("10.0.0.1 kept %v, want [recent]", names)
+	}
+	if len(h.byIP["10.0.0.2"]) != 1 {
+		t.Error("an open interval was pruned")
+	}
+	if _, ok := h.byIP["10.0.0.3"]; ok {
+		t.Error("an IP without intervals left was kept")
+	}
+}
+
+func TestIPHistoryCopiesLabels(t *testing.T) {
+	pod := newTestPod("default", "web", "10.0.0.1", corev1.PodRunning, time.Now())
+	pod.Labels = map[string]string{"app": "web"}
+	h := newIPHistory(defaultHistoryRetention)
+	h.observe(pod)
+
+	// The informer may update the cached object in place
+	pod.Labels["app"] = "api"
+	if got := h.byIP["10.0.0.1"][0].Labels["app"]; got != "web" {
+		t.Errorf("recorded label changed to %q with the pod", got)
+	}
+}
@@ -0,0 +1,55 @@
+package kubernetes
+
+import (
+	"net/netip"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	podIPIndex     = "podIP"
+	serviceIPIndex = "serviceIP"
+)
+
+func indexPodByIP(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	return podIPs(pod), nil
+}
+
+func indexServiceByIP(obj interface{}) ([]string, error) {
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		return nil, nil
+	}
+	return serviceIPs(service), nil
+}
+
+// serviceIPs returns every ClusterIP of a dual-stack service, falling back to
+// spec.clusterIP for objects that predate spec.clusterIPs.
+func serviceIPs(service *corev1.Service) []string {
+	ips := service.Spec.ClusterIPs
+	if len(ips) == 0 && service.Spec.ClusterIP != "" {
+		ips = []string{service.Spec.ClusterIP}
+	}
+	var normalized []string
+	for _, ip := range ips {
+		if ip == corev1.ClusterIPNone {
+			continue
+		}
+		normalized = append(normalized, normalizeIP(ip))
+	}
+	return normalized
+}
+
+// normalizeIP returns the canonical text form of ip so that IPv6 addresses
+// written differently by the API server and the collector still match.
+func normalizeIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	return addr.Unmap().String()
+}
@@ -0,0 +1,136 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultWorkloadLabels are the pod labels copied onto a resolved Workload.
+var DefaultWorkloadLabels = []string{
+	"app.kubernetes.io/name",
+	"app.kubernetes.io/instance",
+	"app.kubernetes.io/component",
+	"app",
+	"version",
+}
+
+// Workload is the stable identity behind an IP: the top-level controller of a
+// pod, the pod itself when it has no controller, or a Service for ClusterIPs.
+type Workload struct {
+	Kind      string
+	Name      string
+	Namespace string
+	Labels    map[string]string
+}
+
+func (w Workload) String() string {
+	return fmt.Sprintf("%s/%s (%s)", w.Namespace, w.Name, w.Kind)
+}
+
+// SetWorkloadLabels selects which pod labels are copied onto resolved workloads.
+func (c *Client) SetWorkloadLabels(keys []string) {
+	c.workloadLabels = append([]string(nil), keys...)
+}
+
+// ResolveWorkload returns the workload that owned ip at ts. Pod IPs are walked
+// up their owner references; service ClusterIPs resolve to the Service.
+func (c *Client) ResolveWorkload(ip string, ts time.Time) (*Workload, error) {
+	if !c.HasSynced() {
+		return nil, ErrCacheNotSynced
+	}
+	if owner, ok := c.history.resolve(ip, ts); ok {
+		kind, name := c.topLevelOwner(owner.Namespace, owner.Name, owner.Labels, owner.OwnerReferences)
+		return &Workload{
+			Kind:      kind,
+			Name:      name,
+			Namespace: owner.Namespace,
+			Labels:    selectLabels(owner.Labels, c.workloadLabels),
+		}, nil
+	}
+	if name, namespace, err := c.GetServiceByIP(ip); err == nil {
+		return &Workload{Kind: "Service", Name: name, Namespace: namespace}, nil
+	}
+	return nil, fmt.Errorf("no workload found for IP %s", ip)
+}
+
+// topLevelOwner follows controller references from a pod up to the outermost
+// controller the caches know about.
+func (c *Client) topLevelOwner(namespace, podName string, podLabels map[string]string, refs []metav1.OwnerReference) (string, string) {
+	ref := controllerRef(refs)
+	if ref == nil {
+		return "Pod", podName
+	}
+
+	switch ref.Kind {
+	case "ReplicaSet":
+		rs, err := c.factory.Apps().V1().ReplicaSets().Lister().ReplicaSets(namespace).Get(ref.Name)
+		if err != nil {
+			// The ReplicaSet may already be garbage collected after a
+			// rollout; fall back to the Deployment naming convention.
+			if deployment, ok := deploymentFromReplicaSetName(ref.Name, podLabels); ok {
+				return "Deployment", deployment
+			}
+			return ref.Kind, ref.Name
+		}
+		return replicaSetOwner(rs)
+	case "Job":
+		job, err := c.factory.Batch().V1().Jobs().Lister().Jobs(namespace).Get(ref.Name)
+		if err != nil {
+			return ref.Kind, ref.Name
+		}
+		if parent := controllerRef(job.OwnerReferences); parent != nil && parent.Kind == "CronJob" {
+			return parent.Kind, parent.Name
+		}
+		return ref.Kind, ref.Name
+	default:
+		// StatefulSet, DaemonSet and any custom controller own pods directly.
+		return ref.Kind, ref.Name
+	}
+}
+
+func replicaSetOwner(rs *appsv1.ReplicaSet) (string, string) {
+	if parent := controllerRef(rs.OwnerReferences); parent != nil {
+		return parent.Kind, parent.Name
+	}
+	return "ReplicaSet", rs.Name
+}
+
+// deploymentFromReplicaSetName strips the pod-template-hash suffix that the
+// Deployment controller appends to ReplicaSet names.
+func deploymentFromReplicaSetName(name string, podLabels map[string]string) (string, bool) {
+	hash := podLabels[appsv1.DefaultDeploymentUniqueLabelKey]
+	if hash == "" || !strings.HasSuffix(name, "-"+hash) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "-"+hash), true
+}
+
+func controllerRef(refs []metav1.OwnerReference) *metav1.OwnerReference {
+	for i := range refs {
+		if refs[i].Controller != nil && *refs[i].Controller {
+			return &refs[i]
+		}
+	}
+	return nil
+}
+
+func selectLabels(podLabels map[string]string, keys []string) map[string]string {
+	selected := make(map[string]string)
+	for _, key := range keys {
+		if value, ok := podLabels[key]; ok {
+			selected[key] = value
+		}
+	}
+	return selected
+}
+
+// podOwnerReferences returns a copy of the pod's owner references so history
+// entries do not alias informer cache objects.
+func podOwnerReferences(pod *corev1.Pod) []metav1.OwnerReference {
+	return append([]metav1.OwnerReference(nil), pod.OwnerReferences...)
+}
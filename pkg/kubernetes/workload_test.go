@@ -0,0 +1,90 @@
+package kubernetes
+
+import (
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// controlledBy returns an owner reference marking kind/name as the controller.
+func controlledBy(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+func TestResolveWorkload(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	deploymentPod := newTestPod("default", "web-5d8f7c9b6-abcde", "10.0.0.1", corev1.PodRunning, start)
+	deploymentPod.OwnerReferences = controlledBy("ReplicaSet", "web-5d8f7c9b6")
+	deploymentPod.Labels = map[string]string{"app": "web", appsv1.DefaultDeploymentUniqueLabelKey: "5d8f7c9b6"}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Name: "web-5d8f7c9b6", Namespace: "default", OwnerReferences: controlledBy("Deployment", "web"),
+	}}
+
+	cronPod := newTestPod("default", "backup-28400000-xyz12", "10.0.0.2", corev1.PodRunning, start)
+	cronPod.OwnerReferences = controlledBy("Job", "backup-28400000")
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+		Name: "backup-28400000", Namespace: "default", OwnerReferences: controlledBy("CronJob", "backup"),
+	}}
+
+	barePod := newTestPod("default", "debug", "10.0.0.3", corev1.PodRunning, start)
+
+	statefulPod := newTestPod("default", "db-0", "10.0.0.4", corev1.PodRunning, start)
+	statefulPod.OwnerReferences = controlledBy("StatefulSet", "db")
+
+	daemonPod := newTestPod("kube-system", "agent-x7k2p", "10.0.0.5", corev1.PodRunning, start)
+	daemonPod.OwnerReferences = controlledBy("DaemonSet", "agent")
+
+	// The ReplicaSet of an old rollout has already been garbage collected
+	orphanPod := newTestPod("default", "api-7b9c6d5f4-fghij", "10.0.0.6", corev1.PodRunning, start)
+	orphanPod.OwnerReferences = controlledBy("ReplicaSet", "api-7b9c6d5f4")
+	orphanPod.Labels = map[string]string{appsv1.DefaultDeploymentUniqueLabelKey: "7b9c6d5f4"}
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.10", ClusterIPs: []string{"10.96.0.10"}},
+	}
+
+	c := startTestClient(t, deploymentPod, replicaSet, cronPod, job, barePod, statefulPod, daemonPod, orphanPod, service)
+
+	tests := []struct {
+		name string
+		ip   string
+		want Workload
+	}{
+		{"deployment pod", "10.0.0.1", Workload{Kind: "Deployment", Name: "web", Namespace: "default"}},
+		{"cron job pod", "10.0.0.2", Workload{Kind: "CronJob", Name: "backup", Namespace: "default"}},
+		{"bare pod", "10.0.0.3", Workload{Kind: "Pod", Name: "debug", Namespace: "default"}},
+		{"stateful set pod", "10.0.0.4", Workload{Kind: "StatefulSet", Name: "db", Namespace: "default"}},
+		{"daemon set pod", "10.0.0.5", Workload{Kind: "DaemonSet", Name: "agent", Namespace: "kube-system"}},
+		{"replica set garbage collected", "10.0.0.6", Workload{Kind: "Deployment", Name: "api", Namespace: "default"}},
+		{"service IP", "10.96.0.10", Workload{Kind: "Service", Name: "web", Namespace: "default"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.ResolveWorkload(tt.ip, start.Add(time.Minute))
+			if err != nil {
+				t.Fatalf("ResolveWorkload(%s) returned %v", tt.ip, err)
+			}
+			if got.Kind != tt.want.Kind || got.Name != tt.want.Name || got.Namespace != tt.want.Namespace {
+				t.Errorf("ResolveWorkload(%s) = %s, want %s", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	got, err := c.ResolveWorkload("10.0.0.1", start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Labels) != 1 || got.Labels["app"] != "web" {
+		t.Errorf("deployment workload labels = %v, want only app=web", got.Labels)
+	}
+	if _, err := c.ResolveWorkload("10.0.0.99", start); err == nil {
+		t.Error("ResolveWorkload of an unknown IP returned no error")
+	}
+}
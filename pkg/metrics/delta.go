@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"maps"
+	"sync"
+)
+
+// DeltaTracker turns cumulative counter readings, such as the values held in
+// eBPF maps, into the increase since the previous reading so they can be
+// added to Prometheus counters once per tick.
+type DeltaTracker[K comparable] struct {
+	mu       sync.Mutex
+	previous map[K]uint64
+}
+
+func NewDeltaTracker[K comparable]() *DeltaTracker[K] {
+	return &DeltaTracker[K]{}
+}
+
+// Update records a complete snapshot of cumulative readings and returns the
+// increase of each key since the previous snapshot.
+//
+// A key seen for the first time contributes its full value. Keys missing
+// from the snapshot are forgotten, so an entry that was evicted and later
+// recreated counts from zero again. A reading below the previous one is a
+// counter reset, for example after the program was reloaded, and the new
+// reading is the increase.
+func (t *DeltaTracker[K]) Update(readings map[K]uint64) map[K]uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deltas := make(map[K]uint64, len(readings))
+	for key, value := range readings {
+		previous, ok := t.previous[key]
+		switch {
+		case !ok, value < previous:
+			deltas[key] = value
+		default:
+			deltas[key] = value - previous
+		}
+	}
+	t.previous = maps.Clone(readings)
+	return deltas
+}
+
+// Reset forgets every previous reading.
+func (t *DeltaTracker[K]) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.previous = nil
+}
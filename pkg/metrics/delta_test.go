@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestDeltaTrackerUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous map[string]uint64
+		readings map[string]uint64
+		want     map[string]uint64
+	}{
+		{
+			name:     "first reading",
+			readings: map[string]uint64{"tcp": 10},
+			want:     map[string]uint64{"tcp": 10},
+		},
+		{
+			name:     "normal increase",
+			previous: map[string]uint64{"tcp": 10, "udp": 5},
+			readings: map[string]uint64{"tcp": 15, "udp": 5},
+			want:     map[string]uint64{"tcp": 5, "udp": 0},
+		},
+		{
+			name:     "counter reset",
+			previous: map[string]uint64{"tcp": 10},
+			readings: map[string]uint64{"tcp": 3},
+			want:     map[string]uint64{"tcp": 3},
+		},
+		{
+			name:     "evicted key",
+			previous: map[string]uint64{"tcp": 10, "udp": 5},
+			readings: map[string]uint64{"tcp": 12},
+			want:     map[string]uint64{"tcp": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewDeltaTracker[string]()
+			if tt.previous != nil {
+				tracker.Update(tt.previous)
+			}
+			if got := tracker.Update(tt.readings); !maps.Equal(got, tt.want) {
+				t.Errorf("Update(%v) = %v, want %v", tt.readings, got, tt.want)
+			}
+		})
+	}
+
+	// An evicted key that comes back counts from zero
+	tracker := NewDeltaTracker[string]()
+	tracker.Update(map[string]uint64{"udp": 5})
+	tracker.Update(map[string]uint64{})
+	if got := tracker.Update(map[string]uint64{"udp": 2}); got["udp"] != 2 {
+		t.Errorf("recreated key increased by %d, want 2", got["udp"])
+	}
+}
@@ -1,7 +1,6 @@
 package metrics
 
 import (
-	"fmt"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,11 +12,27 @@ type Exporter struct {
 	serviceCount      *prometheus.GaugeVec
 	networkTraffic    *prometheus.CounterVec
 	packetDrops       *prometheus.CounterVec
-	connectionLatency *prometheus.HistogramVec
-	packetSize        *prometheus.HistogramVec
+	connectionLatency *constHistograms
+	packetSize        *constHistograms
 	connectionStates  *prometheus.GaugeVec
 	protocolTraffic   *prometheus.CounterVec
-	// retransmissions   *prometheus.CounterVec
+	workloadTraffic   *prometheus.CounterVec
+	serviceTraffic    *prometheus.CounterVec
+	noEndpoints       *prometheus.CounterVec
+	attachmentMode    *prometheus.GaugeVec
+	sampleRate        *prometheus.GaugeVec
+	tcpEvents         *prometheus.CounterVec
+	tcpDuration       *prometheus.HistogramVec
+	flowsEnded        *prometheus.CounterVec
+	mapEntries        *prometheus.GaugeVec
+	mapMaxEntries     *prometheus.GaugeVec
+	mapInsertFailures *prometheus.CounterVec
+	flowEvents        *prometheus.CounterVec
+	lostEvents        *prometheus.CounterVec
+	podPacketDrops    *prometheus.CounterVec
+	retransmissions   *prometheus.CounterVec
+	protocolPackets   *prometheus.CounterVec
+	icmpMessages      *prometheus.CounterVec
 }
 
 func NewExporter() (*Exporter, error) {
@@ -46,45 +61,176 @@ func NewExporter() (*Exporter, error) {
 		packetDrops: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "kubenetinsight_packet_drops",
-				Help: "Number of dropped packets",
+				Help: "Packets dropped by the kernel, by skb drop reason",
 			},
 			[]string{"reason"},
 		),
-		connectionLatency: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "kubenetinsight_connection_latency_seconds",
-				Help:    "Latency of network connections",
-				Buckets: prometheus.ExponentialBuckets(0.0001, 2, 15),
-			},
-			[]string{"source_ip", "destination_ip"},
+		// Both histograms are counted per sample in the kernel, in log2 buckets
+		connectionLatency: newConstHistograms(
+			"kubenetinsight_connection_latency_seconds",
+			"TCP round-trip times, from the handshake or from data segments to their ACK",
+			[]string{"source_ip", "destination_ip", "kind"},
 		),
-		packetSize: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "kubenetinsight_packet_size_bytes",
-				Help:    "Distribution of packet sizes",
-				Buckets: prometheus.ExponentialBuckets(64, 2, 10), // 64B to 32KB
-			},
+		packetSize: newConstHistograms(
+			"kubenetinsight_packet_size_bytes",
+			"Distribution of packet sizes on the wire",
 			[]string{"source", "destination", "protocol"},
 		),
 
 		connectionStates: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "kubenetinsight_connection_states",
-				Help: "Number of connections in each state",
+				Help: "Number of tracked TCP connections in each state",
 			},
-			[]string{"state", "source_ip", "destination_ip", "protocol", "source_port", "destination_port"},
+			[]string{"state"},
 		),
 
 		protocolTraffic: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "kubenetinsight_protocol_traffic_total",
-				Help: "Traffic breakdown by protocol",
+				Help: "Network traffic in bytes by protocol",
 			},
 			[]string{"protocol", "source", "destination"},
 		),
+
+		workloadTraffic: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_workload_traffic_bytes_total",
+				Help: "Network traffic in bytes between workloads",
+			},
+			[]string{"source_namespace", "source_kind", "source_workload", "destination_namespace", "destination_kind", "destination_workload"},
+		),
+
+		serviceTraffic: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_service_traffic_packets_total",
+				Help: "Packets sent to services, by backend pod and port name",
+			},
+			[]string{"namespace", "service", "port_name", "backend_pod"},
+		),
+
+		noEndpoints: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_service_no_endpoints_packets_total",
+				Help: "Packets sent to services that had zero ready endpoints",
+			},
+			[]string{"namespace", "service", "port_name"},
+		),
+
+		attachmentMode: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kubenetinsight_attachment_mode",
+				Help: "Attach mode in use per interface (xdp-driver, xdp-generic, tcx, clsact)",
+			},
+			[]string{"interface", "mode"},
+		),
+		sampleRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kubenetinsight_sample_rate",
+				Help: "Sampling rate in effect per interface: 1 in N packets is recorded in the flow map",
+			},
+			[]string{"interface"},
+		),
+
+		tcpEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_tcp_connection_events_total",
+				Help: "TCP connection opens, closes and resets observed in the datapath",
+			},
+			[]string{"event"},
+		),
+
+		tcpDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "kubenetinsight_tcp_connection_duration_seconds",
+				Help:    "Duration of TCP connections that ended, by workload pair and how they ended",
+				Buckets: prometheus.ExponentialBuckets(0.001, 4, 12), // 1ms to ~70min
+			},
+			[]string{"source_namespace", "source_kind", "source_workload", "destination_namespace", "destination_kind", "destination_workload", "state"},
+		),
+
+		flowsEnded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_flows_ended_total",
+				Help: "Flows expired from the flow table after being idle",
+			},
+			[]string{"protocol"},
+		),
+
+		mapEntries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kubenetinsight_bpf_map_entries",
+				Help: "Entries currently held in each eBPF map",
+			},
+			[]string{"map"},
+		),
+
+		mapMaxEntries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kubenetinsight_bpf_map_max_entries",
+				Help: "Capacity of each eBPF map",
+			},
+			[]string{"map"},
+		),
+
+		mapInsertFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_bpf_map_insert_failures_total",
+				Help: "Inserts into each eBPF map that failed in the kernel",
+			},
+			[]string{"map"},
+		),
+
+		flowEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_flow_events_total",
+				Help: "Flow start, flow end, TCP reset and drop events read from the event stream",
+			},
+			[]string{"type"},
+		),
+
+		lostEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_flow_events_lost_total",
+				Help: "Events lost because the ring buffer (kernel) or the event channel (userspace) was full",
+			},
+			[]string{"source"},
+		),
+
+		podPacketDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_pod_packet_drops_total",
+				Help: "Packets to or from each pod dropped by the kernel, by skb drop reason",
+			},
+			[]string{"namespace", "pod", "reason"},
+		),
+
+		retransmissions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_tcp_retransmissions_total",
+				Help: "TCP segments (data) and SYN-ACKs (synack) retransmitted between workloads",
+			},
+			[]string{"source_namespace", "source_kind", "source_workload", "destination_namespace", "destination_kind", "destination_workload", "kind"},
+		),
+
+		protocolPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_ip_protocol_packets_total",
+				Help: "Packets seen per IP protocol",
+			},
+			[]string{"protocol"},
+		),
+
+		icmpMessages: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubenetinsight_icmp_messages_total",
+				Help: "ICMP and ICMPv6 messages by type and code; frag_needed, ttl_exceeded and dest_unreachable point at MTU and routing problems",
+			},
+			[]string{"source_ip", "destination_ip", "protocol", "message", "type", "code"},
+		),
 	}
 
-	prometheus.MustRegister(e.podCount, e.serviceCount, e.networkTraffic, e.packetDrops, e.connectionLatency, e.packetSize, e.connectionStates, e.protocolTraffic)
+	prometheus.MustRegister(e.podCount, e.serviceCount, e.networkTraffic, e.packetDrops, e.connectionLatency, e.packetSize, e.connectionStates, e.protocolTraffic, e.workloadTraffic, e.serviceTraffic, e.noEndpoints, e.attachmentMode, e.sampleRate, e.tcpEvents, e.tcpDuration, e.flowsEnded, e.mapEntries, e.mapMaxEntries, e.mapInsertFailures, e.flowEvents, e.lostEvents, e.podPacketDrops, e.retransmissions, e.protocolPackets, e.icmpMessages)
 	return e, nil
 }
 
@@ -100,33 +246,108 @@ func (e *Exporter) AddNetworkTraffic(sourceIP, destIP string, bytes float64) {
 	e.networkTraffic.WithLabelValues(sourceIP, destIP).Add(bytes)
 }
 
-func (e *Exporter) IncrementPacketDrops(reason string) {
-	e.packetDrops.WithLabelValues(reason).Inc()
+func (e *Exporter) AddPacketDrops(reason string, count float64) {
+	e.packetDrops.WithLabelValues(reason).Add(count)
 }
 
-func (e *Exporter) ObserveConnectionLatency(sourceIP, destIP string, latency float64) {
-	e.connectionLatency.WithLabelValues(sourceIP, destIP).Observe(latency)
+func (e *Exporter) AddPodPacketDrops(namespace, pod, reason string, count float64) {
+	e.podPacketDrops.WithLabelValues(namespace, pod, reason).Add(count)
 }
 
-func (e *Exporter) ObservePacketSize(source, destination, protocol string, size float64) {
-	e.packetSize.WithLabelValues(source, destination, protocol).Observe(size)
+func (e *Exporter) AddRetransmissions(srcNamespace, srcKind, srcName, dstNamespace, dstKind, dstName, kind string, count float64) {
+	e.retransmissions.WithLabelValues(srcNamespace, srcKind, srcName, dstNamespace, dstKind, dstName, kind).Add(count)
 }
 
-func (e *Exporter) SetConnectionState(sourceIP, destIP string, sourcePort, destPort uint16, protocol, state string, count float64) {
-	e.connectionStates.WithLabelValues(
-		state,
-		sourceIP,
-		destIP,
-		protocol,
-		fmt.Sprintf("%d", sourcePort),
-		fmt.Sprintf("%d", destPort),
-	).Set(count)
+func (e *Exporter) AddProtocolPackets(protocol string, packets float64) {
+	e.protocolPackets.WithLabelValues(protocol).Add(packets)
+}
+
+func (e *Exporter) AddICMPMessages(sourceIP, destIP, protocol, message, icmpType, code string, count float64) {
+	e.icmpMessages.WithLabelValues(sourceIP, destIP, protocol, message, icmpType, code).Add(count)
+}
+
+// SetConnectionLatencies replaces the RTT histograms, labelled by source IP,
+// destination IP and kind, with buckets in seconds.
+func (e *Exporter) SetConnectionLatencies(samples []HistogramSample) {
+	e.connectionLatency.set(samples)
+}
+
+// SetPacketSizes replaces the packet size histograms, labelled by source,
+// destination and protocol, with buckets in bytes.
+func (e *Exporter) SetPacketSizes(samples []HistogramSample) {
+	e.packetSize.set(samples)
+}
+
+// SetConnectionStates replaces the number of connections per TCP state, so
+// that states no connection is in any more stop being reported.
+func (e *Exporter) SetConnectionStates(counts map[string]int) {
+	e.connectionStates.Reset()
+	for state, count := range counts {
+		e.connectionStates.WithLabelValues(state).Set(float64(count))
+	}
 }
 
 func (e *Exporter) AddProtocolTraffic(protocol, source, destination string, bytes float64) {
 	e.protocolTraffic.WithLabelValues(protocol, source, destination).Add(bytes)
 }
 
+func (e *Exporter) AddWorkloadTraffic(srcNamespace, srcKind, srcName, dstNamespace, dstKind, dstName string, bytes float64) {
+	e.workloadTraffic.WithLabelValues(srcNamespace, srcKind, srcName, dstNamespace, dstKind, dstName).Add(bytes)
+}
+
+func (e *Exporter) AddServiceTraffic(namespace, service, portName, backendPod string, packets float64) {
+	e.serviceTraffic.WithLabelValues(namespace, service, portName, backendPod).Add(packets)
+}
+
+func (e *Exporter) AddNoEndpointsTraffic(namespace, service, portName string, packets float64) {
+	e.noEndpoints.WithLabelValues(namespace, service, portName).Add(packets)
+}
+
+// SetSampleRates replaces the sample rate series with rates, keyed by interface.
+func (e *Exporter) SetSampleRates(rates map[string]uint32) {
+	e.sampleRate.Reset()
+	for iface, rate := range rates {
+		e.sampleRate.WithLabelValues(iface).Set(float64(rate))
+	}
+}
+
+// SetAttachmentModes replaces the attachment series with modes, keyed by interface.
+func (e *Exporter) SetAttachmentModes(modes map[string]string) {
+	e.attachmentMode.Reset()
+	for iface, mode := range modes {
+		e.attachmentMode.WithLabelValues(iface, mode).Set(1)
+	}
+}
+
+func (e *Exporter) AddTCPConnectionEvents(event string, count float64) {
+	e.tcpEvents.WithLabelValues(event).Add(count)
+}
+
+func (e *Exporter) ObserveTCPConnectionDuration(srcNamespace, srcKind, srcName, dstNamespace, dstKind, dstName, state string, seconds float64) {
+	e.tcpDuration.WithLabelValues(srcNamespace, srcKind, srcName, dstNamespace, dstKind, dstName, state).Observe(seconds)
+}
+
+func (e *Exporter) AddFlowsEnded(protocol string, count float64) {
+	e.flowsEnded.WithLabelValues(protocol).Add(count)
+}
+
+func (e *Exporter) SetMapUsage(name string, entries, maxEntries float64) {
+	e.mapEntries.WithLabelValues(name).Set(entries)
+	e.mapMaxEntries.WithLabelValues(name).Set(maxEntries)
+}
+
+func (e *Exporter) AddMapInsertFailures(name string, count float64) {
+	e.mapInsertFailures.WithLabelValues(name).Add(count)
+}
+
+func (e *Exporter) IncrementFlowEvents(eventType string) {
+	e.flowEvents.WithLabelValues(eventType).Inc()
+}
+
+func (e *Exporter) AddLostEvents(source string, count float64) {
+	e.lostEvents.WithLabelValues(source).Add(count)
+}
+
 func (e *Exporter) StartServer(port string) {
 	http.Handle("/metrics", promhttp.Handler())
 	http.ListenAndServe(":"+port, nil)
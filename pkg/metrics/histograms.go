@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HistogramSample is one series of a histogram whose buckets are counted
+// outside the process, such as in an eBPF map.
+type HistogramSample struct {
+	Labels []string
+	Count  uint64
+	Sum    float64
+	// Buckets maps each upper bound to the cumulative count of values at or
+	// below it.
+	Buckets map[float64]uint64
+}
+
+// constHistograms publishes the latest samples of a histogram as const
+// metrics. Each update replaces every series, so series whose source is gone
+// disappear rather than freezing at their last value.
+type constHistograms struct {
+	desc *prometheus.Desc
+
+	mu      sync.Mutex
+	samples []HistogramSample
+}
+
+func newConstHistograms(name, help string, labels []string) *constHistograms {
+	return &constHistograms{desc: prometheus.NewDesc(name, help, labels, nil)}
+}
+
+func (h *constHistograms) set(samples []HistogramSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples = samples
+}
+
+func (h *constHistograms) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+func (h *constHistograms) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.samples {
+		m, err := prometheus.NewConstHistogram(h.desc, s.Count, s.Sum, s.Buckets, s.Labels...)
+		if err != nil {
+			m = prometheus.NewInvalidMetric(h.desc, err)
+		}
+		ch <- m
+	}
+}